@@ -0,0 +1,60 @@
+package ntp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// ErrAuthFailed is returned when an authenticated query gets a reply
+// without a valid MAC.
+var ErrAuthFailed = errors.New("reply failed authentication")
+
+// AuthType is the digest algorithm of a symmetric key.
+type AuthType int
+
+const (
+	AuthMD5 AuthType = iota + 1
+	AuthSHA1
+)
+
+// A SymmetricKey is a key shared with the server for classic NTP
+// symmetric key authentication, as configured in the server's keys file.
+type SymmetricKey struct {
+	ID   uint32
+	Type AuthType
+	Key  []byte
+}
+
+// mac returns the MAC to append to packet: the key ID followed by the
+// digest of the key and packet.  See RFC 5905 section 7.3.
+func (k *SymmetricKey) mac(packet []byte) []byte {
+	var h hash.Hash
+	if k.Type == AuthSHA1 {
+		h = sha1.New()
+	} else {
+		h = md5.New()
+	}
+	h.Write(k.Key)
+	h.Write(packet)
+
+	b := make([]byte, 4, 4+h.Size())
+	binary.BigEndian.PutUint32(b, k.ID)
+	return h.Sum(b)
+}
+
+// verify checks that b is a 48 byte header followed by a valid MAC made
+// with k.
+func (k *SymmetricKey) verify(b []byte) error {
+	if len(b) <= headerLen {
+		return ErrAuthFailed
+	}
+	want := k.mac(b[:headerLen])
+	if subtle.ConstantTimeCompare(b[headerLen:], want) != 1 {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package ntp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestMAC(t *testing.T) {
+	// A version 4 client request with all other fields zero.
+	packet := make([]byte, headerLen)
+	packet[0] = 0x23
+	tests := []struct {
+		typ    AuthType
+		digest string
+	}{
+		{AuthMD5, "b2186e2750e85e857402d32d36b4e1d6"},
+		{AuthSHA1, "1081815304db36119a14b938188450c9e9a90ab5"},
+	}
+	for _, tt := range tests {
+		k := &SymmetricKey{ID: 42, Type: tt.typ, Key: []byte("ntp-test-key")}
+		want, _ := hex.DecodeString("0000002a" + tt.digest)
+		mac := k.mac(packet)
+		if !bytes.Equal(mac, want) {
+			t.Errorf("type %d: MAC %x, want %x", tt.typ, mac, want)
+		}
+
+		if err := k.verify(append(packet, mac...)); err != nil {
+			t.Errorf("type %d: valid MAC rejected: %v", tt.typ, err)
+		}
+		mac[len(mac)-1] ^= 1
+		if err := k.verify(append(packet, mac...)); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("type %d: corrupt MAC: err = %v, want ErrAuthFailed", tt.typ, err)
+		}
+		if err := k.verify(packet); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("type %d: missing MAC: err = %v, want ErrAuthFailed", tt.typ, err)
+		}
+	}
+}
+
+func TestAuthenticatedQuery(t *testing.T) {
+	key := &SymmetricKey{ID: 7, Type: AuthSHA1, Key: []byte("secret")}
+	wrong := &SymmetricKey{ID: 7, Type: AuthSHA1, Key: []byte("other")}
+
+	// signer answers requests carrying a valid MAC made with key, signing
+	// the reply with k.
+	signer := func(k *SymmetricKey) func(req, header []byte) []byte {
+		return func(req, header []byte) []byte {
+			if key.verify(req) != nil {
+				t.Errorf("server got request %x without a valid MAC", req)
+			}
+			return k.mac(header)
+		}
+	}
+	s := newServer(t, ntptest.Reply{Stratum: 2, Trailer: signer(key)})
+	opt := QueryOptions{Port: s.Port, Auth: key}
+
+	stats, err := QueryWithOptions(s.Host, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Class != PacketAuthenticated {
+		t.Errorf("reply class %v, want authenticated", stats.Class)
+	}
+
+	for _, r := range []ntptest.Reply{
+		{Stratum: 2, Trailer: signer(wrong)},
+		{Stratum: 2},
+	} {
+		s.SetReply(r)
+		if _, err := QueryWithOptions(s.Host, opt); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("err = %v, want ErrAuthFailed", err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package ntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// binaryVersion is the version of the encoding written by MarshalBinary.
+// Later versions only append fields, so that older decoders can read the
+// fields they know.
+const binaryVersion = 1
+
+// binaryLen is the length of a version 1 encoding.
+const binaryLen = 8 + 6*8 + 5*8
+
+// ErrBinaryEncoding is returned by UnmarshalBinary for data that is not
+// an encoding written by MarshalBinary.
+var ErrBinaryEncoding = errors.New("invalid binary stats encoding")
+
+// MarshalBinary encodes the measured values of s in a compact binary
+// form for passing to another process: the leap indicator, version,
+// stratum and reference identifier, the offset, delay and other
+// durations, and the five timestamps.  Addresses, raw timestamps, the
+// packets and warnings are not included.  The encoding starts with a
+// version byte.
+func (s NtpStats) MarshalBinary() ([]byte, error) {
+	b := make([]byte, binaryLen)
+	b[0] = binaryVersion
+	b[1] = s.Leap
+	b[2] = s.Version
+	b[3] = s.Stratum
+	binary.BigEndian.PutUint32(b[4:], s.ReferenceID)
+
+	p := b[8:]
+	for _, d := range []time.Duration{s.Offset, s.Delay, s.Poll, s.Precision, s.RootDelay, s.RootDispersion} {
+		binary.BigEndian.PutUint64(p, uint64(d))
+		p = p[8:]
+	}
+	for _, t := range []time.Time{s.ReferenceTime, s.OriginTime, s.ReceiveTime, s.TransmitTime, s.DestinationTime} {
+		binary.BigEndian.PutUint64(p, uint64(unixNano(t)))
+		p = p[8:]
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes stats encoded by MarshalBinary into s.  Fields
+// appended by later versions of the encoding are ignored.
+func (s *NtpStats) UnmarshalBinary(b []byte) error {
+	if len(b) < binaryLen || b[0] < 1 {
+		return ErrBinaryEncoding
+	}
+
+	var d NtpStats
+	d.Leap = b[1]
+	d.Version = b[2]
+	d.Stratum = b[3]
+	d.ReferenceID = binary.BigEndian.Uint32(b[4:])
+
+	p := b[8:]
+	for _, f := range []*time.Duration{&d.Offset, &d.Delay, &d.Poll, &d.Precision, &d.RootDelay, &d.RootDispersion} {
+		*f = time.Duration(binary.BigEndian.Uint64(p))
+		p = p[8:]
+	}
+	for _, f := range []*time.Time{&d.ReferenceTime, &d.OriginTime, &d.ReceiveTime, &d.TransmitTime, &d.DestinationTime} {
+		*f = fromUnixNano(int64(binary.BigEndian.Uint64(p)))
+		p = p[8:]
+	}
+	d.ServerProcessingDelay = d.TransmitTime.Sub(d.ReceiveTime)
+
+	*s = d
+	return nil
+}
+
+// unixNano returns t in nanoseconds since the Unix epoch, encoding the
+// zero time, which it cannot represent, as the smallest int64.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(n int64) time.Time {
+	if n == math.MinInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+// trackerStateVersion is the version of the encoding written by
+// Tracker.MarshalState.
+const trackerStateVersion = 1
+
+// trackerStateLen is the length of a tracker state encoding before its
+// samples.
+const trackerStateLen = 8 + 3*8 + 4
+
+// ErrTrackerState is returned by Tracker.LoadState for data that is not
+// a state written by MarshalState.
+var ErrTrackerState = errors.New("invalid tracker state")
+
+// MarshalState encodes the state of t, its filter mode and length, the
+// estimate and the samples it holds, so that it can be saved across a
+// restart and restored by LoadState.  The samples are encoded by
+// MarshalBinary.  StepThreshold and OnStep are not included.
+func (t *Tracker) MarshalState() ([]byte, error) {
+	b := make([]byte, trackerStateLen, trackerStateLen+len(t.recent)*(4+binaryLen))
+	b[0] = trackerStateVersion
+	b[1] = byte(t.mode)
+	binary.BigEndian.PutUint32(b[4:], uint32(t.n))
+	binary.BigEndian.PutUint64(b[8:], uint64(t.offset))
+	binary.BigEndian.PutUint64(b[16:], math.Float64bits(t.weight))
+	binary.BigEndian.PutUint64(b[24:], uint64(t.spike))
+	binary.BigEndian.PutUint32(b[32:], uint32(len(t.recent)))
+	for _, s := range t.recent {
+		sb, err := s.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(sb)))
+		b = append(append(b, l[:]...), sb...)
+	}
+	return b, nil
+}
+
+// LoadState replaces the state of t with one encoded by MarshalState,
+// including its filter mode and length, so that later updates carry on
+// from the saved estimate.  On error t is unchanged.
+func (t *Tracker) LoadState(b []byte) error {
+	if len(b) < trackerStateLen || b[0] < 1 {
+		return ErrTrackerState
+	}
+	mode := FilterMode(b[1])
+	n := int(binary.BigEndian.Uint32(b[4:]))
+	if mode != Smoothing && mode != Median || n < 1 {
+		return ErrTrackerState
+	}
+
+	count := binary.BigEndian.Uint32(b[32:])
+	var samples []time.Duration
+	var recent []NtpStats
+	p := b[trackerStateLen:]
+	for i := uint32(0); i < count; i++ {
+		if len(p) < 4 || uint32(len(p)-4) < binary.BigEndian.Uint32(p) {
+			return ErrTrackerState
+		}
+		l := binary.BigEndian.Uint32(p)
+		var s NtpStats
+		if err := s.UnmarshalBinary(p[4 : 4+l]); err != nil {
+			return ErrTrackerState
+		}
+		p = p[4+l:]
+		samples = append(samples, s.Offset)
+		recent = append(recent, s)
+	}
+	if len(samples) > n {
+		samples = samples[len(samples)-n:]
+		recent = recent[len(recent)-n:]
+	}
+
+	t.mode, t.n = mode, n
+	t.offset = time.Duration(binary.BigEndian.Uint64(b[8:]))
+	t.weight = math.Float64frombits(binary.BigEndian.Uint64(b[16:]))
+	t.spike = time.Duration(binary.BigEndian.Uint64(b[24:]))
+	t.samples, t.recent, t.stepped = samples, recent, false
+	return nil
+}
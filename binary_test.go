@@ -0,0 +1,99 @@
+package ntp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestMarshalBinary(t *testing.T) {
+	s := newServer(t, ntptest.Reply{
+		Leap:           1,
+		Stratum:        2,
+		ReferenceID:    "GPS",
+		Poll:           6,
+		Precision:      -20,
+		RootDelay:      3 * ms,
+		RootDispersion: 2 * ms,
+		ReferenceTime:  time.Now().Add(-time.Minute),
+		Offset:         -7 * ms,
+	})
+	stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := stats.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != binaryLen || b[0] != binaryVersion {
+		t.Fatalf("encoding of %d bytes with version %d", len(b), b[0])
+	}
+
+	// A later version may append fields, which are skipped.
+	b = append(b, 1, 2, 3)
+	b[0] = binaryVersion + 1
+	var got NtpStats
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Leap != stats.Leap || got.Version != stats.Version || got.Stratum != stats.Stratum || got.ReferenceID != stats.ReferenceID {
+		t.Errorf("header decoded as %d %d %d %#x, want %d %d %d %#x", got.Leap, got.Version, got.Stratum, got.ReferenceID,
+			stats.Leap, stats.Version, stats.Stratum, stats.ReferenceID)
+	}
+	for _, f := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"Offset", got.Offset, stats.Offset},
+		{"Delay", got.Delay, stats.Delay},
+		{"Poll", got.Poll, stats.Poll},
+		{"Precision", got.Precision, stats.Precision},
+		{"RootDelay", got.RootDelay, stats.RootDelay},
+		{"RootDispersion", got.RootDispersion, stats.RootDispersion},
+		{"ServerProcessingDelay", got.ServerProcessingDelay, stats.ServerProcessingDelay},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s decoded as %v, want %v", f.name, f.got, f.want)
+		}
+	}
+	for _, f := range []struct {
+		name      string
+		got, want time.Time
+	}{
+		{"ReferenceTime", got.ReferenceTime, stats.ReferenceTime},
+		{"OriginTime", got.OriginTime, stats.OriginTime},
+		{"ReceiveTime", got.ReceiveTime, stats.ReceiveTime},
+		{"TransmitTime", got.TransmitTime, stats.TransmitTime},
+		{"DestinationTime", got.DestinationTime, stats.DestinationTime},
+	} {
+		if !f.got.Equal(f.want) {
+			t.Errorf("%s decoded as %v, want %v", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestMarshalBinaryZero(t *testing.T) {
+	b, err := NtpStats{}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NtpStats{Stratum: 3, OriginTime: t0}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Stratum != 0 || !got.OriginTime.IsZero() || !got.DestinationTime.IsZero() {
+		t.Errorf("zero stats decoded as stratum %d, times %v and %v", got.Stratum, got.OriginTime, got.DestinationTime)
+	}
+
+	for name, bad := range map[string][]byte{
+		"empty":     nil,
+		"truncated": b[:binaryLen-1],
+		"version 0": append([]byte{0}, b[1:]...),
+	} {
+		if err := got.UnmarshalBinary(bad); err != ErrBinaryEncoding {
+			t.Errorf("decoding %s encoding: err = %v, want ErrBinaryEncoding", name, err)
+		}
+	}
+}
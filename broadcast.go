@@ -0,0 +1,158 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrWrongSource is returned when the only packets received before the
+// deadline came from addresses other than the expected server.
+var ErrWrongSource = errors.New("no reply from the expected server")
+
+// ReceiveBroadcast listens on opt.Port for a packet from an NTP server
+// in broadcast mode, waiting at most opt.Timeout, and returns the stats
+// it gives.  With no request sent there is no round trip to measure, so
+// Delay is zero and Offset includes the one-way network delay.  The
+// returned stats have Broadcast set.
+func ReceiveBroadcast(opt QueryOptions) (NtpStats, error) {
+	return ReceiveBroadcastContext(context.Background(), opt)
+}
+
+// ReceiveBroadcastContext is like ReceiveBroadcast but gives up,
+// returning ctx.Err(), when ctx is done.
+func ReceiveBroadcastContext(ctx context.Context, opt QueryOptions) (NtpStats, error) {
+	return receiveBroadcast(ctx, opt, nil)
+}
+
+// ReceiveBroadcastFrom is like ReceiveBroadcast but only accepts packets
+// sent by host, discarding any from other addresses.  Resolving host is
+// bounded by opt.ResolveTimeout.
+func ReceiveBroadcastFrom(host string, opt QueryOptions) (NtpStats, error) {
+	return ReceiveBroadcastFromContext(context.Background(), host, opt)
+}
+
+// ReceiveBroadcastFromContext is like ReceiveBroadcastFrom but gives up,
+// returning ctx.Err(), when ctx is done.
+func ReceiveBroadcastFromContext(ctx context.Context, host string, opt QueryOptions) (NtpStats, error) {
+	rctx, cancel := context.WithTimeout(ctx, opt.resolveTimeout())
+	addrs, err := lookupIPAddr(rctx, host)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return NtpStats{}, ctx.Err()
+		}
+		return NtpStats{}, &TransportError{"resolve", err}
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return receiveBroadcast(ctx, opt, ips)
+}
+
+// receiveBroadcast waits for a broadcast packet, from one of the
+// addresses in from unless it is nil.
+func receiveBroadcast(ctx context.Context, opt QueryOptions, from []net.IP) (NtpStats, error) {
+	if err := ctx.Err(); err != nil {
+		return NtpStats{}, err
+	}
+	var lc net.ListenConfig
+	if opt.ReusePort {
+		lc.Control = reuseControl
+	}
+	deadline := time.Now().Add(opt.timeout())
+	release, err := acquireSocket(ctx, deadline)
+	if err != nil {
+		if ctx.Err() != nil {
+			return NtpStats{}, ctx.Err()
+		}
+		return NtpStats{}, &TransportError{"dial", err}
+	}
+	defer release()
+	pc, err := lc.ListenPacket(ctx, "udp", net.JoinHostPort("", strconv.Itoa(opt.port())))
+	if err != nil {
+		if ctx.Err() != nil {
+			return NtpStats{}, ctx.Err()
+		}
+		return NtpStats{}, &TransportError{"dial", err}
+	}
+	con := pc.(*net.UDPConn)
+	defer con.Close()
+	con.SetDeadline(deadline)
+	defer watchContext(ctx, con)()
+
+	buf := make([]byte, 1024)
+	wrongSource := false
+	for {
+		n, raddr, err := con.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return NtpStats{}, ctx.Err()
+			}
+			if wrongSource {
+				return NtpStats{}, ErrWrongSource
+			}
+			return NtpStats{}, &TransportError{"read", err}
+		}
+		destinationTime := time.Now()
+
+		if from != nil && !containsIP(from, raddr.IP) {
+			wrongSource = true
+			continue
+		}
+
+		m, err := parsePacket(buf[:n])
+		if err != nil || Mode(m.LiVnMode&0x07) != ModeBroadcast {
+			continue
+		}
+
+		transmitTime := m.TransmitTime.UTC()
+		if transmitTime.Before(time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			return NtpStats{}, errors.New("received zero packet")
+		}
+
+		stats := NtpStats{
+			Offset:         transmitTime.Sub(destinationTime),
+			Leap:           m.LiVnMode >> 6,
+			Mode:           ModeBroadcast,
+			Version:        (m.LiVnMode >> 3) & 0x07,
+			Stratum:        m.Stratum,
+			ReferenceID:    m.ReferenceId,
+			Poll:           log2ToDuration(int8(m.Poll)),
+			Precision:      log2ToDuration(int8(m.Precision)),
+			RootDelay:      ShortToDuration(m.RootDelay),
+			RootDispersion: ShortToDuration(m.RootDispersion),
+
+			LocalAddr:  con.LocalAddr(),
+			RemoteAddr: raddr,
+			Broadcast:  true,
+
+			TransmitBeforeRef: transmitTime.Before(m.ReferenceTime.UTC()),
+
+			ReplyLen:      n,
+			ReplyChecksum: crc32.ChecksumIEEE(buf[:n]),
+			Class:         ClassifyPacket(buf[:n]),
+
+			ReferenceTime:   m.ReferenceTime.UTC(),
+			TransmitTime:    transmitTime,
+			DestinationTime: destinationTime,
+
+			RawReferenceTime: m.ReferenceTime.raw(),
+			RawTransmitTime:  m.TransmitTime.raw(),
+		}
+		return stats, nil
+	}
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// broadcastMsg returns a version 4 broadcast packet sent at t.
+func broadcastMsg(t time.Time) []byte {
+	m := &msg{Stratum: 2, ReferenceTime: toNtpTime(t.Add(-time.Minute)), TransmitTime: toNtpTime(t)}
+	m.SetVersion(4)
+	m.SetMode(ModeBroadcast)
+	return encodeMsg(m)
+}
+
+// broadcaster sends broadcast packets from ip to port on 127.0.0.1 every
+// few milliseconds until the test ends.  The test is skipped where ip
+// cannot be bound.
+func broadcaster(t *testing.T, ip net.IP, port int) {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("cannot listen on the loopback network: %v", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+		c.Close()
+	})
+	go func() {
+		defer close(done)
+		to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+		for {
+			c.WriteToUDP(broadcastMsg(time.Now()), to)
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+}
+
+func TestReceiveBroadcastFrom(t *testing.T) {
+	port := closedPort(t)
+	opt := QueryOptions{Port: port, Timeout: 200 * ms}
+
+	broadcaster(t, net.IPv4(127, 0, 0, 2), port)
+	if _, err := ReceiveBroadcastFrom("127.0.0.3", opt); !errors.Is(err, ErrWrongSource) {
+		t.Fatalf("packets from another server only: err = %v, want ErrWrongSource", err)
+	}
+
+	broadcaster(t, net.IPv4(127, 0, 0, 3), port)
+	stats, err := ReceiveBroadcastFrom("127.0.0.3", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := stats.RemoteAddr.(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 3)) {
+		t.Errorf("accepted a packet from %v", ip)
+	}
+	if !stats.Broadcast || stats.Mode != ModeBroadcast || stats.Stratum != 2 {
+		t.Errorf("stats %+v, want a stratum 2 broadcast", stats)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	lc := net.ListenConfig{Control: reuseControl}
+	a, err := lc.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		t.Skipf("port reuse unavailable: %v", err)
+	}
+	defer a.Close()
+	port := a.LocalAddr().(*net.UDPAddr).Port
+
+	b, err := lc.ListenPacket(context.Background(), "udp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("second listener with port reuse: %v", err)
+	}
+	defer b.Close()
+
+	// A listener must ask for reuse to share the port.
+	if _, err := ReceiveBroadcast(QueryOptions{Port: port, Timeout: 50 * ms}); err == nil || isTimeout(err) {
+		t.Errorf("without ReusePort: err = %v, want a bind error", err)
+	}
+	if _, err := ReceiveBroadcast(QueryOptions{Port: port, Timeout: 50 * ms, ReusePort: true}); !isTimeout(err) {
+		t.Errorf("with ReusePort: err = %v, want a timeout waiting for a packet", err)
+	}
+}
+
+func TestBroadcastErrors(t *testing.T) {
+	phase := func(err error) string {
+		var te *TransportError
+		if !errors.As(err, &te) {
+			return ""
+		}
+		return te.Phase
+	}
+
+	// The port is already taken.
+	held, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	port := held.LocalAddr().(*net.UDPAddr).Port
+	if _, err := ReceiveBroadcast(QueryOptions{Port: port, Timeout: 50 * ms}); phase(err) != "dial" {
+		t.Errorf("port in use: err = %v, want a dial TransportError", err)
+	}
+
+	// Nothing is broadcast.
+	opt := QueryOptions{Port: closedPort(t), Timeout: 50 * ms}
+	if _, err := ReceiveBroadcast(opt); phase(err) != "read" || !isTimeout(err) {
+		t.Errorf("no broadcast: err = %v, want a read TransportError timing out", err)
+	}
+
+	// No socket is free within the timeout.
+	defer SetMaxSockets(DefaultMaxSockets)
+	SetMaxSockets(1)
+	release, err := acquireSocket(context.Background(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReceiveBroadcast(opt); phase(err) != "dial" || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("no socket free: err = %v, want a dial TransportError from the deadline", err)
+	}
+	release()
+}
+
+func TestReceiveBroadcastFromResolver(t *testing.T) {
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = f }(lookupIPAddr)
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host == "broadcaster.example" {
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 3)}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	port := closedPort(t)
+	opt := QueryOptions{Port: port, Timeout: 200 * ms}
+	_, err := ReceiveBroadcastFrom("missing.example", opt)
+	var te *TransportError
+	var de *net.DNSError
+	if !errors.As(err, &te) || te.Phase != "resolve" || !errors.As(err, &de) || !de.IsNotFound {
+		t.Errorf("unknown host: err = %v, want a resolve TransportError", err)
+	}
+
+	broadcaster(t, net.IPv4(127, 0, 0, 3), port)
+	stats, err := ReceiveBroadcastFrom("broadcaster.example", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := stats.RemoteAddr.(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 3)) {
+		t.Errorf("accepted a packet from %v", ip)
+	}
+}
@@ -0,0 +1,367 @@
+package ntp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"time"
+)
+
+// ErrNoSamples is returned by the functions analysing a set of samples
+// when given none.
+var ErrNoSamples = errors.New("no samples")
+
+// minFitDelay is the delay assumed, for weighting, for samples reporting
+// less.
+const minFitDelay = time.Microsecond
+
+// QueryBurst queries host n times, waiting interval between queries, and
+// returns the samples of the queries that succeeded.  Only servers that
+// allow it should be queried faster than every few seconds.  If every
+// query fails the last error is returned.
+func QueryBurst(host string, n int, interval time.Duration, opt QueryOptions) ([]NtpStats, error) {
+	return QueryBurstContext(context.Background(), host, n, interval, opt)
+}
+
+// QueryBurstContext is like QueryBurst but gives up, returning ctx.Err(),
+// when ctx is done.
+func QueryBurstContext(ctx context.Context, host string, n int, interval time.Duration, opt QueryOptions) ([]NtpStats, error) {
+	var samples []NtpStats
+	var err error
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			if err := sleepContext(ctx, interval); err != nil {
+				return nil, err
+			}
+		}
+		var s NtpStats
+		s, err = QueryContext(ctx, host, opt)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			samples = append(samples, s)
+		}
+	}
+	if len(samples) == 0 && err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// QueryPipelined sends n requests to host back to back and then reads the
+// replies, matching them to the requests by origin time, in whatever
+// order they arrive.  This takes little longer than a single query but
+// burdens the server as much as n of them.  The stats and errors are in
+// the order the requests were sent; requests left unanswered when
+// opt.Timeout expires fail with a timeout error.  Datagrams matching no
+// outstanding request are discarded.  opt.Sink is given each reply as it
+// is matched.  If n is not positive nothing is sent and the results are
+// empty.
+func QueryPipelined(host string, n int, opt QueryOptions) ([]NtpStats, []error) {
+	return QueryPipelinedContext(context.Background(), host, n, opt)
+}
+
+// QueryPipelinedContext is like QueryPipelined but gives up when ctx is
+// done, the unanswered requests failing with ctx.Err().
+func QueryPipelinedContext(ctx context.Context, host string, n int, opt QueryOptions) ([]NtpStats, []error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	stats := make([]NtpStats, n)
+	errs := make([]error, n)
+	fail := func(err error) ([]NtpStats, []error) {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		for i := range errs {
+			errs[i] = err
+		}
+		return stats, errs
+	}
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, opt.resolveTimeout())
+	addrs, err := resolve(rctx, host, opt)
+	cancel()
+	if err != nil {
+		return fail(&TransportError{"resolve", err})
+	}
+	deadline := time.Now().Add(opt.timeout())
+	con, err := dial(ctx, addrs[0], opt, deadline)
+	if err != nil {
+		return fail(err)
+	}
+	defer con.Close()
+	con.SetDeadline(deadline)
+	defer watchContext(ctx, con)()
+
+	// Each request needs a distinct transmit time for its reply to be
+	// told apart.
+	reqs := make([]*request, n)
+	pending := make(map[ntpTime]int, n)
+	for i := range reqs {
+		r := &request{opt: opt}
+		r.xmit = toNtpTime(time.Now())
+		if !opt.TransmitTime.IsZero() {
+			r.xmit = toNtpTime(opt.TransmitTime)
+		}
+		for _, dup := pending[r.xmit]; dup; _, dup = pending[r.xmit] {
+			r.xmit.Fraction++
+		}
+		if err := r.send(con); err != nil {
+			return fail(&TransportError{"write", err})
+		}
+		reqs[i] = r
+		pending[r.xmit] = i
+	}
+
+	buf := make([]byte, opt.maxReplyLen()+1)
+	for len(pending) > 0 {
+		k, err := con.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			} else {
+				err = &TransportError{"read", err}
+			}
+			for _, i := range pending {
+				errs[i] = err
+			}
+			break
+		}
+		destinationTime := now()
+		if k < headerLen {
+			continue
+		}
+		var m msg
+		binary.Read(bytes.NewReader(buf[:headerLen]), binary.BigEndian, &m)
+		i, ok := pending[m.OriginTime]
+		if !ok {
+			continue
+		}
+		delete(pending, m.OriginTime)
+		stats[i], errs[i] = reqs[i].reply(buf[:k], destinationTime)
+		if errs[i] == nil {
+			stats[i].LocalAddr = con.LocalAddr()
+			stats[i].RemoteAddr = con.RemoteAddr()
+			if opt.Sink != nil {
+				opt.Sink.Apply(stats[i].Offset, stats[i])
+			}
+		}
+	}
+	return stats, errs
+}
+
+// FitOffset fits a line to the offsets of samples against the local time
+// each was measured at, the midpoint of its request and reply, by least
+// squares weighted by the inverse of the delay, so that samples less
+// disturbed by network queueing count more.  It returns the fitted offset
+// at the time of the latest sample and the slope, the frequency error of
+// the local clock as a fraction: positive if it runs slow.
+func FitOffset(samples []NtpStats) (time.Duration, float64, error) {
+	if len(samples) == 0 {
+		return 0, 0, ErrNoSamples
+	}
+
+	t0 := samples[0].midpoint()
+	var last float64
+	var sw, sx, sy float64
+	xs := make([]float64, len(samples))
+	ws := make([]float64, len(samples))
+	for i, s := range samples {
+		d := s.Delay
+		if d < minFitDelay {
+			d = minFitDelay
+		}
+		xs[i] = s.midpoint().Sub(t0).Seconds()
+		ws[i] = 1 / d.Seconds()
+		if xs[i] > last {
+			last = xs[i]
+		}
+		sw += ws[i]
+		sx += ws[i] * xs[i]
+		sy += ws[i] * s.Offset.Seconds()
+	}
+	mx, my := sx/sw, sy/sw
+
+	var sxy, sxx float64
+	for i, s := range samples {
+		dx := xs[i] - mx
+		sxy += ws[i] * dx * (s.Offset.Seconds() - my)
+		sxx += ws[i] * dx * dx
+	}
+	slope := 0.0
+	if sxx > 0 {
+		slope = sxy / sxx
+	}
+
+	offset := my + slope*(last-mx)
+	return time.Duration(offset * 1e9), slope, nil
+}
+
+// BurstOffset queries host n times at the given interval and returns the
+// offset fitted by FitOffset.
+func BurstOffset(host string, n int, interval time.Duration, opt QueryOptions) (time.Duration, error) {
+	return BurstOffsetContext(context.Background(), host, n, interval, opt)
+}
+
+// BurstOffsetContext is like BurstOffset but gives up, returning
+// ctx.Err(), when ctx is done.
+func BurstOffsetContext(ctx context.Context, host string, n int, interval time.Duration, opt QueryOptions) (time.Duration, error) {
+	samples, err := QueryBurstContext(ctx, host, n, interval, opt)
+	if err != nil {
+		return 0, err
+	}
+	offset, _, err := FitOffset(samples)
+	return offset, err
+}
+
+// midpoint returns the local time halfway between sending the request and
+// receiving the reply.
+func (s NtpStats) midpoint() time.Time {
+	return s.OriginTime.Add(s.DestinationTime.Sub(s.OriginTime) / 2)
+}
+
+// minLoadGrowth is the least rise in processing delay across a burst for
+// a server to be reported as growing more loaded, below which the change
+// is taken for noise.
+const minLoadGrowth = 10 * time.Microsecond
+
+// A ServerLoad summarizes the processing delays of a burst of replies
+// from one server.
+type ServerLoad struct {
+	Mean time.Duration
+	Max  time.Duration
+
+	// Trend is the change in processing delay from the first sample to
+	// the last, fitted by least squares.  Growing is set when it is a
+	// rise of at least 10µs over three or more samples.
+	Trend   time.Duration
+	Growing bool
+}
+
+// EstimateLoad summarizes the ServerProcessingDelay of samples, taken in
+// order from one server, as an indication of how loaded it is.
+func EstimateLoad(samples []NtpStats) (ServerLoad, error) {
+	if len(samples) == 0 {
+		return ServerLoad{}, ErrNoSamples
+	}
+
+	var l ServerLoad
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s.ServerProcessingDelay)
+		if s.ServerProcessingDelay > l.Max {
+			l.Max = s.ServerProcessingDelay
+		}
+	}
+	n := float64(len(samples))
+	mean := sum / n
+	l.Mean = time.Duration(mean)
+
+	mx := (n - 1) / 2
+	var sxy, sxx float64
+	for i, s := range samples {
+		dx := float64(i) - mx
+		sxy += dx * (float64(s.ServerProcessingDelay) - mean)
+		sxx += dx * dx
+	}
+	if sxx > 0 {
+		l.Trend = time.Duration(sxy / sxx * (n - 1))
+	}
+	l.Growing = len(samples) >= 3 && l.Trend >= minLoadGrowth
+	return l, nil
+}
+
+// QueryLoad queries host n times, waiting interval between queries, and
+// estimates its load from the replies.
+func QueryLoad(host string, n int, interval time.Duration, opt QueryOptions) (ServerLoad, error) {
+	return QueryLoadContext(context.Background(), host, n, interval, opt)
+}
+
+// QueryLoadContext is like QueryLoad but gives up, returning ctx.Err(),
+// when ctx is done.
+func QueryLoadContext(ctx context.Context, host string, n int, interval time.Duration, opt QueryOptions) (ServerLoad, error) {
+	samples, err := QueryBurstContext(ctx, host, n, interval, opt)
+	if err != nil {
+		return ServerLoad{}, err
+	}
+	return EstimateLoad(samples)
+}
+
+// A PrecisionReport compares the precision servers advertise with the
+// granularity their timestamps show.
+type PrecisionReport struct {
+	Advertised time.Duration // the largest Precision of the replies
+
+	// Observed is the coarsest step, a power of two or of ten seconds,
+	// that every receive and transmit timestamp is a multiple of.
+	// Servers filling the bits below their precision with random values,
+	// as ntpd does, show a fine granularity.
+	Observed time.Duration
+
+	// Mismatch is set when Observed is more than twice Advertised, the
+	// server's clock being coarser than it claims.
+	Mismatch bool
+}
+
+// CheckPrecision compares the advertised precision of samples, such as a
+// burst from QueryBurst, with the granularity of their timestamps.  The
+// more samples, the less likely a fine clock is to look coarse by chance.
+func CheckPrecision(samples []NtpStats) (PrecisionReport, error) {
+	if len(samples) == 0 {
+		return PrecisionReport{}, ErrNoSamples
+	}
+
+	var r PrecisionReport
+	var ts []Timestamp
+	for _, s := range samples {
+		if s.Precision > r.Advertised {
+			r.Advertised = s.Precision
+		}
+		ts = append(ts, s.RawReceiveTime, s.RawTransmitTime)
+	}
+	r.Observed = granularity(ts)
+	r.Mismatch = r.Observed > 2*r.Advertised
+	return r, nil
+}
+
+// granularity returns the coarsest power of two or of ten seconds, the
+// latter from a microsecond up, that every timestamp in ts is a multiple
+// of.  Powers of ten are matched to within a nanosecond, to allow for the
+// rounding of the conversion to NTP format.
+func granularity(ts []Timestamp) time.Duration {
+	tz := 64
+	for _, t := range ts {
+		if n := bits.TrailingZeros64(uint64(t)); n < tz {
+			tz = n
+		}
+	}
+	var g time.Duration
+	if tz >= 32 {
+		g = time.Second
+	} else {
+		g = time.Duration(uint64(time.Second) >> uint(32-tz))
+	}
+
+	for step := time.Second; step >= time.Microsecond && step > g; step /= 10 {
+		multiple := true
+		for _, t := range ts {
+			ns := time.Duration((uint64(t)&0xffffffff*1e9 + 1<<31) >> 32)
+			if r := ns % step; r > 1 && r < step-1 {
+				multiple = false
+				break
+			}
+		}
+		if multiple {
+			g = step
+			break
+		}
+	}
+	return g
+}
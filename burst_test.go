@@ -0,0 +1,216 @@
+package ntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+// driftSample returns a sample taken at t0 plus at, with the given delay,
+// from a local clock off by 1ms plus 10 ppm of at.
+func driftSample(at, delay time.Duration) NtpStats {
+	return NtpStats{
+		OriginTime:      t0.Add(at - delay/2),
+		DestinationTime: t0.Add(at + delay/2),
+		Delay:           delay,
+		Offset:          ms + at/100000,
+	}
+}
+
+func TestFitOffset(t *testing.T) {
+	var samples []NtpStats
+	for i := 0; i < 10; i++ {
+		samples = append(samples, driftSample(time.Duration(i)*time.Second, 10*ms))
+	}
+	offset, slope, err := FitOffset(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ms + 90*time.Microsecond; abs(offset-want) > time.Microsecond {
+		t.Errorf("offset = %v, want %v", offset, want)
+	}
+	if slope < 9.99e-6 || slope > 10.01e-6 {
+		t.Errorf("slope = %g, want 10 ppm", slope)
+	}
+
+	// A sample delayed 500ms in a queue, 50ms off the line, barely moves
+	// the fit.
+	samples[4].Offset += 50 * ms
+	samples[4].Delay = 500 * ms
+	offset, _, err = FitOffset(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ms + 90*time.Microsecond; abs(offset-want) > 200*time.Microsecond {
+		t.Errorf("offset with a delayed outlier = %v, want within 200µs of %v", offset, want)
+	}
+
+	if _, _, err := FitOffset(nil); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("no samples: err = %v, want ErrNoSamples", err)
+	}
+}
+
+func TestEstimateLoad(t *testing.T) {
+	held := func(ds ...time.Duration) []NtpStats {
+		s := make([]NtpStats, len(ds))
+		for i, d := range ds {
+			s[i].ServerProcessingDelay = d
+		}
+		return s
+	}
+	us := time.Microsecond
+	tests := []struct {
+		name    string
+		samples []NtpStats
+		want    ServerLoad
+	}{
+		{"growing", held(100*us, 200*us, 300*us, 400*us, 500*us), ServerLoad{300 * us, 500 * us, 400 * us, true}},
+		{"steady", held(300*us, 300*us, 300*us), ServerLoad{300 * us, 300 * us, 0, false}},
+		{"shrinking", held(500*us, 300*us, 100*us), ServerLoad{300 * us, 500 * us, -400 * us, false}},
+		{"too few", held(100*us, 500*us), ServerLoad{300 * us, 500 * us, 400 * us, false}},
+		{"noise", held(100*us, 105*us, 108*us), ServerLoad{104333 * time.Nanosecond, 108 * us, 8 * us, false}},
+	}
+	for _, tt := range tests {
+		got, err := EstimateLoad(tt.samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: EstimateLoad() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := EstimateLoad(nil); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("no samples: err = %v, want ErrNoSamples", err)
+	}
+}
+
+func TestQueryLoad(t *testing.T) {
+	// The server holds each request 1ms longer than the one before.
+	now := time.Now()
+	var replies []ntptest.Reply
+	for i := 0; i < 4; i++ {
+		recv := now.Add(time.Duration(i) * 10 * ms)
+		replies = append(replies, ntptest.Reply{Stratum: 2, ReceiveTime: recv, TransmitTime: recv.Add(time.Duration(i+1) * ms)})
+	}
+	s := newServer(t, replies[0])
+	s.SetReplies(replies...)
+
+	l, err := QueryLoad(s.Host, 4, time.Millisecond, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Max != 4*ms || l.Mean != 2500*time.Microsecond || abs(l.Trend-3*ms) > time.Microsecond || !l.Growing {
+		t.Errorf("QueryLoad() = %+v, want a load growing from 1ms to 4ms", l)
+	}
+}
+
+func TestCheckPrecision(t *testing.T) {
+	// samples returns a burst advertising the given precision whose
+	// server timestamps are t0 plus multiples of step.
+	samples := func(precision int8, step func(i int) Timestamp) []NtpStats {
+		base := toNtpTime(t0).raw()
+		var ss []NtpStats
+		for i := 1; i <= 8; i++ {
+			ss = append(ss, NtpStats{
+				Precision:       log2ToDuration(precision),
+				RawReceiveTime:  base + step(2*i),
+				RawTransmitTime: base + step(2*i+1),
+			})
+		}
+		return ss
+	}
+	millis := func(i int) Timestamp { return toNtpTime(t0.Add(time.Duration(7*i)*ms)).raw() - toNtpTime(t0).raw() }
+	pow2 := func(i int) Timestamp { return Timestamp(3*i) << 22 }
+	fine := func(i int) Timestamp { return Timestamp(i*0x1234567 | 1) }
+
+	tests := []struct {
+		name     string
+		samples  []NtpStats
+		observed time.Duration
+		mismatch bool
+	}{
+		{"millisecond clock claiming 1µs", samples(-20, millis), ms, true},
+		{"millisecond clock claiming 1ms", samples(-10, millis), ms, false},
+		{"2^-10s clock claiming 2^-10s", samples(-10, pow2), time.Second >> 10, false},
+		{"2^-10s clock claiming 2^-20s", samples(-20, pow2), time.Second >> 10, true},
+		{"fine clock claiming 1µs", samples(-20, fine), 0, false},
+	}
+	for _, tt := range tests {
+		r, err := CheckPrecision(tt.samples)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if r.Advertised != tt.samples[0].Precision {
+			t.Errorf("%s: Advertised = %v, want %v", tt.name, r.Advertised, tt.samples[0].Precision)
+		}
+		if r.Observed != tt.observed || r.Mismatch != tt.mismatch {
+			t.Errorf("%s: Observed %v, Mismatch %v, want %v, %v", tt.name, r.Observed, r.Mismatch, tt.observed, tt.mismatch)
+		}
+	}
+
+	if _, err := CheckPrecision(nil); !errors.Is(err, ErrNoSamples) {
+		t.Errorf("no samples: err = %v, want ErrNoSamples", err)
+	}
+}
+
+func TestQueryPipelined(t *testing.T) {
+	// A server holding back its replies until it has every request, then
+	// answering the last first with a stray datagram in between, and
+	// leaving the request at index skip unanswered.  Each reply's stratum
+	// is one more than the index of the request it answers.
+	const n, skip = 4, 2
+	pipelined := func() int {
+		var reqs [][]byte
+		return rawServer(t, func(req []byte) [][]byte {
+			reqs = append(reqs, append([]byte(nil), req...))
+			if len(reqs) < n {
+				return nil
+			}
+			var out [][]byte
+			for i := n - 1; i >= 0; i-- {
+				now := time.Now()
+				m := serverMsg(now, now, now.Add(ms))
+				m.Stratum = byte(i + 1)
+				if i == skip {
+					out = append(out, encodeMsg(m)) // answers nothing
+					continue
+				}
+				m.OriginTime = ntpTime{binary.BigEndian.Uint32(reqs[i][40:]), binary.BigEndian.Uint32(reqs[i][44:])}
+				out = append(out, encodeMsg(m))
+			}
+			reqs = nil
+			return out
+		})
+	}
+
+	sink := &recordingSink{}
+	opt := QueryOptions{Port: pipelined(), Timeout: 200 * ms, Sink: sink}
+	stats, errs := QueryPipelined("127.0.0.1", n, opt)
+	if len(stats) != n || len(errs) != n {
+		t.Fatalf("%d stats and %d errors, want %d", len(stats), len(errs), n)
+	}
+	for i := 0; i < n; i++ {
+		if i == skip {
+			if !isTimeout(errs[i]) {
+				t.Errorf("unanswered request %d: err = %v, want a timeout", i, errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil || stats[i].Stratum != byte(i+1) {
+			t.Errorf("request %d: stratum %d, err %v, want the reply to that request", i, stats[i].Stratum, errs[i])
+		}
+	}
+	if len(sink.stats) != n-1 {
+		t.Errorf("Sink given %d replies, want %d", len(sink.stats), n-1)
+	}
+
+	for _, bad := range []int{0, -1} {
+		if stats, errs := QueryPipelined("127.0.0.1", bad, opt); stats != nil || errs != nil {
+			t.Errorf("n = %d: %v, %v, want no results", bad, stats, errs)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by Client.Query when NoWait is set and the
+// minimum interval since the previous query has not yet elapsed.
+var ErrRateLimited = errors.New("query rate limited")
+
+// ErrStratumIncreased is returned by Client.Query, with
+// RejectStratumIncrease set, for a reply whose stratum has risen too far
+// above that of the first reply.
+var ErrStratumIncreased = errors.New("server stratum increased")
+
+// defaultMinInterval is the minimum spacing between queries when neither
+// the Client nor the server specifies one.
+const defaultMinInterval = 4 * time.Second
+
+// maxPollInterval is the longest server poll interval a Client adopts,
+// 2^17 seconds or about 36 hours, the MAXPOLL of RFC 5905, so that a
+// server advertising an absurd poll cannot stall it.
+const maxPollInterval = 1 << 17 * time.Second
+
+// A Client queries a single NTP server repeatedly, enforcing a minimum
+// interval between queries so as not to abuse public servers.  A reply
+// repeating the previous one is rejected with ErrDuplicatePacket.  A
+// Client is safe for concurrent use.
+type Client struct {
+	Host    string
+	Options QueryOptions
+
+	// MinInterval is the minimum time between the start of two queries.
+	// If zero, the server's advertised poll interval is used, but never
+	// less than 4 seconds nor more than 2^17 seconds (about 36 hours).
+	MinInterval time.Duration
+
+	// NoWait makes Query return ErrRateLimited instead of blocking when
+	// called before the minimum interval has elapsed.
+	NoWait bool
+
+	// OnServerChange, if set, is called when a reply comes from a
+	// different address or with a different stratum than the previous
+	// one, as happens when a pool hostname rotates between members.
+	OnServerChange func(prev, cur NtpStats)
+
+	// StratumIncrease, if non-zero, is the rise in stratum above that of
+	// the first reply of the session at which a reply is considered a
+	// regression to a worse source.  OnStratumIncrease, if set, is then
+	// called with the first reply and the current one, and if
+	// RejectStratumIncrease is set the query fails with
+	// ErrStratumIncreased.
+	StratumIncrease       int
+	OnStratumIncrease     func(baseline, cur NtpStats)
+	RejectStratumIncrease bool
+
+	mu       sync.Mutex
+	last     time.Time
+	poll     time.Duration
+	prev     *NtpStats
+	baseline *NtpStats
+}
+
+// NewClient returns a Client querying host with the given options.
+func NewClient(host string, opt QueryOptions) *Client {
+	return &Client{Host: host, Options: opt}
+}
+
+// Query queries the Client's server, first waiting for the minimum
+// interval since the previous query to elapse.
+func (c *Client) Query() (NtpStats, error) {
+	return c.QueryContext(context.Background())
+}
+
+// QueryContext is like Query but gives up, returning ctx.Err(), when ctx
+// is done, whether while waiting or querying.
+func (c *Client) QueryContext(ctx context.Context) (NtpStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.last.IsZero() {
+		wait := c.interval() - time.Since(c.last)
+		if wait > 0 {
+			if c.NoWait {
+				return NtpStats{}, ErrRateLimited
+			}
+			if err := sleepContext(ctx, wait); err != nil {
+				return NtpStats{}, err
+			}
+		}
+	}
+	c.last = time.Now()
+
+	opt := c.Options
+	if c.prev != nil {
+		opt.lastTransmit = c.prev.RawTransmitTime
+	}
+	stats, err := QueryContext(ctx, c.Host, opt)
+	if err != nil {
+		return stats, err
+	}
+	c.poll = stats.Poll
+
+	if c.baseline == nil {
+		c.baseline = &stats
+	} else if c.StratumIncrease > 0 && int(stats.Stratum)-int(c.baseline.Stratum) >= c.StratumIncrease {
+		if c.OnStratumIncrease != nil {
+			c.OnStratumIncrease(*c.baseline, stats)
+		}
+		if c.RejectStratumIncrease {
+			return NtpStats{}, ErrStratumIncreased
+		}
+	}
+
+	if c.prev != nil && c.OnServerChange != nil && serverChanged(*c.prev, stats) {
+		c.OnServerChange(*c.prev, stats)
+	}
+	c.prev = &stats
+	return stats, nil
+}
+
+// serverChanged reports whether prev and cur appear to come from different
+// servers.
+func serverChanged(prev, cur NtpStats) bool {
+	if prev.Stratum != cur.Stratum {
+		return true
+	}
+	if prev.RemoteAddr == nil || cur.RemoteAddr == nil {
+		return prev.RemoteAddr != cur.RemoteAddr
+	}
+	return prev.RemoteAddr.String() != cur.RemoteAddr.String()
+}
+
+// wait returns how long until the next query is allowed.
+func (c *Client) wait() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last.IsZero() {
+		return 0
+	}
+	return c.interval() - time.Since(c.last)
+}
+
+func (c *Client) interval() time.Duration {
+	if c.MinInterval > 0 {
+		return c.MinInterval
+	}
+	switch {
+	case c.poll > maxPollInterval:
+		return maxPollInterval
+	case c.poll > defaultMinInterval:
+		return c.poll
+	}
+	return defaultMinInterval
+}
+
+// ErrNoResult is returned by CachedClient.Last before any query has
+// succeeded.
+var ErrNoResult = errors.New("no successful query yet")
+
+// A CachedClient keeps querying a server in the background, at the
+// interval a Client allows, and serves the last successful result without
+// waiting for the network.
+type CachedClient struct {
+	client *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	stats   NtpStats
+	updated time.Time
+	err     error
+}
+
+// NewCachedClient starts querying host with the given options.  The caller
+// should call Close when finished.
+func NewCachedClient(host string, opt QueryOptions) *CachedClient {
+	return newCachedClient(NewClient(host, opt))
+}
+
+// newCachedClient starts querying with client, which it takes over.
+func newCachedClient(client *Client) *CachedClient {
+	c := &CachedClient{
+		client: client,
+		done:   make(chan struct{}),
+		err:    ErrNoResult,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.refresh()
+	return c
+}
+
+// Last returns the result of the last successful query and its age.  Its
+// Offset stays valid for correcting the local clock as long as the age is
+// small compared to the rate the clocks drift apart.  Before the first
+// success the error of the last failed query is returned, or
+// ErrNoResult.
+func (c *CachedClient) Last() (NtpStats, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updated.IsZero() {
+		return NtpStats{}, 0, c.err
+	}
+	return c.stats, time.Since(c.updated), nil
+}
+
+// Close stops the background queries, abandoning any in progress.
+func (c *CachedClient) Close() {
+	c.cancel()
+	<-c.done
+}
+
+func (c *CachedClient) refresh() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.client.wait()):
+		}
+
+		stats, err := c.client.QueryContext(c.ctx)
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.mu.Lock()
+		if err == nil {
+			c.stats, c.updated = stats, time.Now()
+		} else if c.updated.IsZero() {
+			c.err = err
+		}
+		c.mu.Unlock()
+	}
+}
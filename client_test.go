@@ -0,0 +1,246 @@
+package ntp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestClientMinInterval(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	c := &Client{Host: s.Host, Options: QueryOptions{Port: s.Port}, MinInterval: 50 * ms}
+
+	// The second and third queries each wait for the interval to pass.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Query(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 2*c.MinInterval {
+		t.Errorf("3 queries took %v, want at least %v", d, 2*c.MinInterval)
+	}
+
+	c.NoWait = true
+	if _, err := c.Query(); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("early query with NoWait: err = %v, want ErrRateLimited", err)
+	}
+	time.Sleep(c.MinInterval)
+	if _, err := c.Query(); err != nil {
+		t.Errorf("query after the interval: %v", err)
+	}
+}
+
+func TestClientDefaultInterval(t *testing.T) {
+	c := &Client{}
+	if d := c.interval(); d != defaultMinInterval {
+		t.Errorf("interval with no poll = %v, want %v", d, defaultMinInterval)
+	}
+	c.poll = 64 * time.Second
+	if d := c.interval(); d != 64*time.Second {
+		t.Errorf("interval with a 64s poll = %v, want 64s", d)
+	}
+	c.poll = time.Second
+	if d := c.interval(); d != defaultMinInterval {
+		t.Errorf("interval with a 1s poll = %v, want %v", d, defaultMinInterval)
+	}
+}
+
+func TestClientPollClamped(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	tests := []struct {
+		poll int8
+		want time.Duration
+	}{
+		{6, 64 * time.Second},
+		{17, maxPollInterval},
+		{18, maxPollInterval},
+		{33, maxPollInterval},
+		{127, maxPollInterval},
+		{-6, defaultMinInterval},
+	}
+	for _, tt := range tests {
+		s.SetReply(ntptest.Reply{Stratum: 2, Poll: tt.poll})
+		c := NewClient(s.Host, QueryOptions{Port: s.Port})
+		if _, err := c.Query(); err != nil {
+			t.Fatal(err)
+		}
+		if w := c.wait(); w > tt.want || w < tt.want-time.Second {
+			t.Errorf("poll 2^%d: wait %v, want about %v", tt.poll, w, tt.want)
+		}
+	}
+}
+
+func TestClientServerChange(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	var changes [][2]byte
+	c := &Client{
+		Host:        s.Host,
+		Options:     QueryOptions{Port: s.Port},
+		MinInterval: time.Millisecond,
+		OnServerChange: func(prev, cur NtpStats) {
+			changes = append(changes, [2]byte{prev.Stratum, cur.Stratum})
+		},
+	}
+
+	// The pool rotates to a stratum 3 member after two samples.
+	for _, stratum := range []byte{2, 2, 3, 3} {
+		s.SetReply(ntptest.Reply{Stratum: stratum})
+		if _, err := c.Query(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(changes) != 1 || changes[0] != [2]byte{2, 3} {
+		t.Errorf("changes reported: %v, want one from stratum 2 to 3", changes)
+	}
+}
+
+func TestServerChanged(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 123}
+	tests := []struct {
+		prev, cur NtpStats
+		want      bool
+	}{
+		{NtpStats{Stratum: 2, RemoteAddr: a}, NtpStats{Stratum: 2, RemoteAddr: a}, false},
+		{NtpStats{Stratum: 2, RemoteAddr: a}, NtpStats{Stratum: 2, RemoteAddr: b}, true},
+		{NtpStats{Stratum: 2, RemoteAddr: a}, NtpStats{Stratum: 1, RemoteAddr: a}, true},
+		{NtpStats{Stratum: 2}, NtpStats{Stratum: 2}, false},
+	}
+	for _, tt := range tests {
+		if got := serverChanged(tt.prev, tt.cur); got != tt.want {
+			t.Errorf("serverChanged(%v/%v, %v/%v) = %v, want %v",
+				tt.prev.Stratum, tt.prev.RemoteAddr, tt.cur.Stratum, tt.cur.RemoteAddr, got, tt.want)
+		}
+	}
+}
+
+// waitFor polls cond until it holds or a second passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestCachedClient(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	c := newCachedClient(&Client{Host: s.Host, Options: QueryOptions{Port: s.Port}, MinInterval: 20 * ms})
+	defer c.Close()
+
+	waitFor(t, "the first result", func() bool {
+		_, _, err := c.Last()
+		return err == nil
+	})
+
+	// The server changes, and a background refresh picks it up.
+	s.SetReply(ntptest.Reply{Stratum: 3})
+	waitFor(t, "a refresh", func() bool {
+		stats, age, err := c.Last()
+		if err != nil || age < 0 || age > time.Second {
+			t.Fatalf("Last() = stratum %d, age %v, err %v", stats.Stratum, age, err)
+		}
+		return stats.Stratum == 3
+	})
+}
+
+func TestCachedClientClose(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	opt := QueryOptions{Port: silent.LocalAddr().(*net.UDPAddr).Port, Timeout: 10 * time.Second}
+	c := NewCachedClient("127.0.0.1", opt)
+	if _, _, err := c.Last(); !errors.Is(err, ErrNoResult) {
+		t.Errorf("Last() before any reply: err = %v, want ErrNoResult", err)
+	}
+
+	// Close abandons the query in progress rather than waiting it out.
+	time.Sleep(20 * ms)
+	start := time.Now()
+	c.Close()
+	if d := time.Since(start); d > 500*ms {
+		t.Errorf("Close took %v", d)
+	}
+}
+
+func TestClientDuplicate(t *testing.T) {
+	// A server stuck repeating one reply.
+	now := time.Now()
+	s := newServer(t, ntptest.Reply{Stratum: 2, ReceiveTime: now, TransmitTime: now})
+	c := &Client{Host: s.Host, Options: QueryOptions{Port: s.Port}, MinInterval: time.Millisecond}
+	if _, err := c.Query(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Query(); err != ErrDuplicatePacket {
+		t.Errorf("repeated reply: err = %v, want ErrDuplicatePacket", err)
+	}
+
+	// Once the server moves on, its replies are accepted again.
+	s.SetReply(ntptest.Reply{Stratum: 2})
+	if _, err := c.Query(); err != nil {
+		t.Errorf("new reply: %v", err)
+	}
+
+	// A one-off query has no previous reply to be a duplicate of.
+	s.SetReply(ntptest.Reply{Stratum: 2, ReceiveTime: now, TransmitTime: now})
+	for i := 0; i < 2; i++ {
+		if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port}); err != nil {
+			t.Errorf("one-off query %d: %v", i, err)
+		}
+	}
+}
+
+func TestClientBogus(t *testing.T) {
+	// A server answering with an origin time that is not the request's
+	// transmit time, as a stale or spoofed reply would.
+	port := rawServer(t, func(req []byte) [][]byte {
+		now := time.Now()
+		return [][]byte{encodeMsg(serverMsg(now.Add(-time.Hour), now, now))}
+	})
+	c := &Client{Host: "127.0.0.1", Options: QueryOptions{Port: port}, MinInterval: time.Millisecond}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Query(); err != ErrBogusPacket {
+			t.Errorf("query %d: err = %v, want ErrBogusPacket", i, err)
+		}
+	}
+}
+
+func TestClientStratumIncrease(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	var flagged [][2]byte
+	c := &Client{
+		Host:            s.Host,
+		Options:         QueryOptions{Port: s.Port},
+		MinInterval:     time.Millisecond,
+		StratumIncrease: 2,
+		OnStratumIncrease: func(baseline, cur NtpStats) {
+			flagged = append(flagged, [2]byte{baseline.Stratum, cur.Stratum})
+		},
+	}
+
+	// Stratum 3 is within the threshold of the first reply's 2; 4 and 5
+	// are not, and neither is measured against the one before it.
+	for _, stratum := range []byte{2, 3, 4, 5, 2} {
+		s.SetReply(ntptest.Reply{Stratum: stratum})
+		if _, err := c.Query(); err != nil {
+			t.Fatalf("stratum %d: %v", stratum, err)
+		}
+	}
+	if want := [][2]byte{{2, 4}, {2, 5}}; len(flagged) != len(want) || flagged[0] != want[0] || flagged[1] != want[1] {
+		t.Errorf("increases flagged: %v, want %v", flagged, want)
+	}
+
+	c.RejectStratumIncrease = true
+	s.SetReply(ntptest.Reply{Stratum: 4})
+	if _, err := c.Query(); err != ErrStratumIncreased {
+		t.Errorf("with RejectStratumIncrease: err = %v, want ErrStratumIncreased", err)
+	}
+}
@@ -0,0 +1,162 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// firstErr returns the first of errs that is not context.Canceled, or
+// context.Canceled if they all are.
+func firstErr(errs []error) error {
+	for _, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	return context.Canceled
+}
+
+func TestContextCancel(t *testing.T) {
+	// A server that never answers and a timeout far longer than the test,
+	// so every call only returns through cancellation.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	raddr := silent.LocalAddr().(*net.UDPAddr)
+	host := raddr.IP.String()
+	opt := QueryOptions{Port: raddr.Port, Timeout: time.Minute}
+	hosts := []string{host, host}
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{"QueryContext", func(ctx context.Context) error {
+			_, err := QueryContext(ctx, host, opt)
+			return err
+		}},
+		{"Client.QueryContext", func(ctx context.Context) error {
+			_, err := NewClient(host, opt).QueryContext(ctx)
+			return err
+		}},
+		{"QueryPacketConnContext", func(ctx context.Context) error {
+			con, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer con.Close()
+			_, err = QueryPacketConnContext(ctx, con, raddr, opt)
+			return err
+		}},
+		{"QueryBurstContext", func(ctx context.Context) error {
+			_, err := QueryBurstContext(ctx, host, 3, ms, opt)
+			return err
+		}},
+		{"QueryPipelinedContext", func(ctx context.Context) error {
+			_, errs := QueryPipelinedContext(ctx, host, 3, opt)
+			return firstErr(errs)
+		}},
+		{"BurstOffsetContext", func(ctx context.Context) error {
+			_, err := BurstOffsetContext(ctx, host, 3, ms, opt)
+			return err
+		}},
+		{"QueryLoadContext", func(ctx context.Context) error {
+			_, err := QueryLoadContext(ctx, host, 3, ms, opt)
+			return err
+		}},
+		{"ReadVariablesContext", func(ctx context.Context) error {
+			_, err := ReadVariablesContext(ctx, host, 0, opt)
+			return err
+		}},
+		{"ReceiveBroadcastContext", func(ctx context.Context) error {
+			_, err := ReceiveBroadcastContext(ctx, QueryOptions{Port: closedPort(t), Timeout: time.Minute})
+			return err
+		}},
+		{"ReceiveBroadcastFromContext", func(ctx context.Context) error {
+			_, err := ReceiveBroadcastFromContext(ctx, host, QueryOptions{Port: closedPort(t), Timeout: time.Minute})
+			return err
+		}},
+		{"ProbeVersionsContext", func(ctx context.Context) error {
+			r := ProbeVersionsContext(ctx, host, opt)
+			return firstErr([]error{r.V3Err, r.V4Err})
+		}},
+		{"QueryPairContext", func(ctx context.Context) error {
+			_, err := QueryPairContext(ctx, host, opt, ms)
+			return err
+		}},
+		{"QueryInterfacesContext", func(ctx context.Context) error {
+			_, errs := QueryInterfacesContext(ctx, host, []net.IP{net.IPv4(127, 0, 0, 1)}, opt)
+			return firstErr(errs)
+		}},
+		{"ScanCIDRContext", func(ctx context.Context) error {
+			_, errs := ScanCIDRContext(ctx, host+"/32", opt)
+			return firstErr([]error{errs[host]})
+		}},
+		{"QueryManyContext", func(ctx context.Context) error {
+			_, errs := QueryManyContext(ctx, hosts, opt)
+			return firstErr(errs)
+		}},
+		{"QuerySelectContext", func(ctx context.Context) error {
+			_, err := QuerySelectContext(ctx, hosts, opt, MinDelay)
+			return err
+		}},
+		{"ServerDeltaContext", func(ctx context.Context) error {
+			_, err := ServerDeltaContext(ctx, host, host, opt)
+			return err
+		}},
+		{"PoolTimeContext", func(ctx context.Context) error {
+			_, _, err := PoolTimeContext(ctx, hosts, opt)
+			return err
+		}},
+		{"PoolTimeTraceContext", func(ctx context.Context) error {
+			_, _, _, err := PoolTimeTraceContext(ctx, hosts, opt)
+			return err
+		}},
+		{"BestTimeContext", func(ctx context.Context) error {
+			_, _, err := BestTimeContext(ctx, hosts, opt)
+			return err
+		}},
+		{"StabilizedOffsetContext", func(ctx context.Context) error {
+			_, err := StabilizedOffsetContext(ctx, host, ms, 3, opt)
+			return err
+		}},
+		{"StrictOffsetContext", func(ctx context.Context) error {
+			_, err := StrictOffsetContext(ctx, host, opt)
+			return err
+		}},
+		{"PollContext", func(ctx context.Context) error {
+			PollContext(ctx, host, ms, PollOptions{QueryOptions: opt}, func(s Sample) bool {
+				t.Errorf("PollContext called fn with %v", s.Err)
+				return true
+			})
+			return context.Canceled
+		}},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		timer := time.AfterFunc(50*ms, cancel)
+		start := time.Now()
+		err := tt.call(ctx)
+		elapsed := time.Since(start)
+		timer.Stop()
+		cancel()
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: err = %v, want context.Canceled", tt.name, err)
+		}
+		if elapsed > time.Second {
+			t.Errorf("%s: returned %v after being cancelled", tt.name, elapsed)
+		}
+
+		// An already cancelled context fails without waiting.
+		start = time.Now()
+		if err := tt.call(ctx); !errors.Is(err, context.Canceled) || time.Since(start) > 100*ms {
+			t.Errorf("%s with a cancelled context: err = %v after %v", tt.name, err, time.Since(start))
+		}
+	}
+}
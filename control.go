@@ -0,0 +1,188 @@
+package ntp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// opReadVariables is the control message read variables opcode.
+// See RFC 1305 Appendix B.
+const opReadVariables = 2
+
+const (
+	ctlResponse = 0x80 // R bit: set by the server on responses
+	ctlError    = 0x40 // E bit: set on error responses
+	ctlMore     = 0x20 // M bit: more fragments follow
+	ctlOpMask   = 0x1f
+
+	ctlHeaderLen  = 12
+	ctlMaxDataLen = 468
+)
+
+type ctlHeader struct {
+	LiVnMode      byte // Leap Indicator (2) + Version (3) + Mode (3)
+	REMOp         byte // Response (1) + Error (1) + More (1) + Opcode (5)
+	Sequence      uint16
+	Status        uint16
+	AssociationId uint16
+	Offset        uint16
+	Count         uint16
+}
+
+// ReadVariables sends a mode 6 read variables request to the NTP server
+// specified as host and returns the variables it reports for the given
+// association.  Association 0 selects the system variables.
+//
+// Every name=value pair in the reply is returned with any surrounding
+// quotes removed; values are left as strings.  For the system association
+// ntpd reports, among others: version, leap, stratum, precision, rootdelay,
+// rootdisp, refid, reftime, clock, peer, offset, frequency, sys_jitter,
+// clk_jitter and clk_wander.  Peer associations report srcadr, srcport,
+// dstadr, stratum, reach, delay, offset, jitter and similar.  Many public
+// servers disable mode 6 and will not answer.
+//
+// The server is addressed, and the socket set up, as for QueryWithOptions
+// by opt, which also gives the timeouts; the other options are ignored.
+func ReadVariables(host string, assoc uint16, opt QueryOptions) (map[string]string, error) {
+	return ReadVariablesContext(context.Background(), host, assoc, opt)
+}
+
+// ReadVariablesContext is like ReadVariables but gives up, returning
+// ctx.Err(), when ctx is done.
+func ReadVariablesContext(ctx context.Context, host string, assoc uint16, opt QueryOptions) (map[string]string, error) {
+	vars, err := readVariables(ctx, host, assoc, opt)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return vars, err
+}
+
+func readVariables(ctx context.Context, host string, assoc uint16, opt QueryOptions) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rctx, cancel := context.WithTimeout(ctx, opt.resolveTimeout())
+	addrs, err := resolve(rctx, host, opt)
+	cancel()
+	if err != nil {
+		return nil, &TransportError{"resolve", err}
+	}
+
+	deadline := time.Now().Add(opt.timeout())
+	con, err := dial(ctx, addrs[0], opt, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+	con.SetDeadline(deadline)
+	defer watchContext(ctx, con)()
+
+	seq := uint16(time.Now().UnixNano())
+	h := ctlHeader{
+		LiVnMode:      2<<3 | byte(ModeControl),
+		REMOp:         opReadVariables,
+		Sequence:      seq,
+		AssociationId: assoc,
+	}
+	var req bytes.Buffer
+	binary.Write(&req, binary.BigEndian, &h)
+	if err := writePacket(con, req.Bytes()); err != nil {
+		return nil, &TransportError{"write", err}
+	}
+
+	data, err := readControlResponse(con, seq)
+	if err != nil {
+		return nil, err
+	}
+	return parseVariables(data), nil
+}
+
+// readControlResponse reads and reassembles the fragments of a control
+// message response matching sequence number seq.
+func readControlResponse(con net.Conn, seq uint16) ([]byte, error) {
+	frags := make(map[uint16][]byte)
+	end := -1
+
+	buf := make([]byte, ctlHeaderLen+ctlMaxDataLen+4)
+	for {
+		n, err := con.Read(buf)
+		if err != nil {
+			return nil, &TransportError{"read", err}
+		}
+		if n < ctlHeaderLen {
+			return nil, errors.New("short control message")
+		}
+
+		var h ctlHeader
+		binary.Read(bytes.NewReader(buf[:ctlHeaderLen]), binary.BigEndian, &h)
+		if Mode(h.LiVnMode&0x07) != ModeControl || h.REMOp&ctlResponse == 0 ||
+			h.REMOp&ctlOpMask != opReadVariables || h.Sequence != seq {
+			continue // not a reply to our request
+		}
+		if h.REMOp&ctlError != 0 {
+			return nil, errors.New("control message error response")
+		}
+		if int(h.Count) > n-ctlHeaderLen {
+			return nil, errors.New("truncated control message")
+		}
+
+		frags[h.Offset] = append([]byte(nil), buf[ctlHeaderLen:ctlHeaderLen+int(h.Count)]...)
+		if h.REMOp&ctlMore == 0 {
+			end = int(h.Offset) + int(h.Count)
+		}
+
+		// Reassemble once every byte up to the final fragment is present.
+		if end >= 0 {
+			data := make([]byte, 0, end)
+			for len(data) < end {
+				f, ok := frags[uint16(len(data))]
+				if !ok || len(f) == 0 {
+					break
+				}
+				data = append(data, f...)
+			}
+			if len(data) == end {
+				return data, nil
+			}
+		}
+	}
+}
+
+// parseVariables splits a control message variable list of the form
+// name=value, name="value", ... into a map.
+func parseVariables(data []byte) map[string]string {
+	vars := make(map[string]string)
+	s := strings.TrimRight(string(data), "\x00")
+
+	for len(s) > 0 {
+		// Find the end of the item, skipping commas inside quotes.
+		i, quoted := 0, false
+		for ; i < len(s); i++ {
+			if s[i] == '"' {
+				quoted = !quoted
+			} else if s[i] == ',' && !quoted {
+				break
+			}
+		}
+		item := strings.TrimSpace(s[:i])
+		if i < len(s) {
+			i++
+		}
+		s = s[i:]
+
+		if item == "" {
+			continue
+		}
+		name, value := item, ""
+		if eq := strings.IndexByte(item, '='); eq >= 0 {
+			name, value = strings.TrimSpace(item[:eq]), strings.TrimSpace(item[eq+1:])
+		}
+		vars[name] = strings.Trim(value, "\"")
+	}
+	return vars
+}
@@ -0,0 +1,148 @@
+package ntp
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// ctlFrag returns a read variables response fragment to the request with
+// sequence number seq, holding data at offset, with the given extra R, E
+// and M bits, padded with NULs to a multiple of four bytes as ntpd does.
+func ctlFrag(seq uint16, bits byte, offset int, data string) []byte {
+	b := make([]byte, ctlHeaderLen, ctlHeaderLen+len(data)+3)
+	b[0] = 2<<3 | byte(ModeControl)
+	b[1] = ctlResponse | bits | opReadVariables
+	binary.BigEndian.PutUint16(b[2:], seq)
+	binary.BigEndian.PutUint16(b[8:], uint16(offset))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(data)))
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// controlServer answers each read variables request with the fragments
+// respond returns for its sequence number and association.
+func controlServer(t *testing.T, respond func(seq, assoc uint16) [][]byte) QueryOptions {
+	t.Helper()
+	port := rawServer(t, func(req []byte) [][]byte {
+		if len(req) != ctlHeaderLen || req[0] != 2<<3|byte(ModeControl) || req[1] != opReadVariables {
+			return nil
+		}
+		return respond(binary.BigEndian.Uint16(req[2:]), binary.BigEndian.Uint16(req[6:]))
+	})
+	return QueryOptions{Port: port, Timeout: 100 * ms}
+}
+
+func TestReadVariables(t *testing.T) {
+	const vars = `version="ntpd 4.2.8p15", stratum=2, refid=GPS, clock="e82c1c45.1a2b3c4d  Wed, Oct 14 2026 12:00:05.102", sys_jitter=0.001234`
+	// Fragments of 40 bytes, the last one first, behind a stray reply to
+	// another request and a fragment of the wrong opcode.
+	opt := controlServer(t, func(seq, assoc uint16) [][]byte {
+		if assoc != 7 {
+			t.Errorf("association %d requested, want 7", assoc)
+		}
+		var frags [][]byte
+		for off := 0; off < len(vars); off += 40 {
+			end, more := off+40, byte(ctlMore)
+			if end >= len(vars) {
+				end, more = len(vars), 0
+			}
+			frags = append(frags, ctlFrag(seq, more, off, vars[off:end]))
+		}
+		wrongOp := ctlFrag(seq, 0, 0, "stratum=9")
+		wrongOp[1] = ctlResponse | 1
+		out := [][]byte{ctlFrag(seq+1, 0, 0, "stratum=9"), wrongOp, frags[len(frags)-1]}
+		for i := len(frags) - 2; i >= 0; i-- {
+			out = append(out, frags[i])
+		}
+		return out
+	})
+
+	got, err := ReadVariables("127.0.0.1", 7, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"version":    "ntpd 4.2.8p15",
+		"stratum":    "2",
+		"refid":      "GPS",
+		"clock":      "e82c1c45.1a2b3c4d  Wed, Oct 14 2026 12:00:05.102",
+		"sys_jitter": "0.001234",
+	}
+	if len(got) != len(expected) {
+		t.Errorf("variables %q, want %q", got, expected)
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestReadVariablesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(seq uint16) [][]byte
+		check   func(err error) bool
+	}{
+		{"error bit", func(seq uint16) [][]byte {
+			return [][]byte{ctlFrag(seq, ctlError, 0, "")}
+		}, func(err error) bool { return err != nil && strings.Contains(err.Error(), "error response") }},
+		{"truncated", func(seq uint16) [][]byte {
+			b := ctlFrag(seq, 0, 0, "stratum=2")
+			binary.BigEndian.PutUint16(b[10:], 200)
+			return [][]byte{b}
+		}, func(err error) bool { return err != nil && strings.Contains(err.Error(), "truncated") }},
+		{"sequence mismatch", func(seq uint16) [][]byte {
+			return [][]byte{ctlFrag(seq^0x8000, 0, 0, "stratum=2")}
+		}, isTimeout},
+		{"missing fragment", func(seq uint16) [][]byte {
+			return [][]byte{ctlFrag(seq, ctlMore, 0, "stratum=2, "), ctlFrag(seq, 0, 20, "refid=GPS")}
+		}, isTimeout},
+	}
+	for _, tt := range tests {
+		respond := tt.respond
+		opt := controlServer(t, func(seq, assoc uint16) [][]byte { return respond(seq) })
+		vars, err := ReadVariables("127.0.0.1", 0, opt)
+		if vars != nil || !tt.check(err) {
+			t.Errorf("%s: ReadVariables() = %q, %v", tt.name, vars, err)
+		}
+	}
+}
+
+func TestParseVariables(t *testing.T) {
+	tests := []struct {
+		data string
+		want map[string]string
+	}{
+		{"stratum=2, refid=GPS", map[string]string{"stratum": "2", "refid": "GPS"}},
+		{`srcadr="192.0.2.1", flash="00 ok, no, really"`, map[string]string{"srcadr": "192.0.2.1", "flash": "00 ok, no, really"}},
+		{"leap=00,\r\nstratum=1\r\n\x00\x00\x00", map[string]string{"leap": "00", "stratum": "1"}},
+		{"peer, , x = 5 ,", map[string]string{"peer": "", "x": "5"}},
+		{"\x00\x00\x00\x00", map[string]string{}},
+	}
+	for _, tt := range tests {
+		got := parseVariables([]byte(tt.data))
+		if len(got) != len(tt.want) {
+			t.Errorf("parseVariables(%q) = %q, want %q", tt.data, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if w, ok := got[k]; !ok || w != v {
+				t.Errorf("parseVariables(%q)[%q] = %q, want %q", tt.data, k, w, v)
+			}
+		}
+	}
+}
+
+func TestWritePacket(t *testing.T) {
+	if err := writePacket(shortWriter{ctlHeaderLen - 1}, make([]byte, ctlHeaderLen)); err != ErrShortWrite {
+		t.Errorf("short write of a control request: err = %v, want ErrShortWrite", err)
+	}
+	if err := writePacket(shortWriter{ctlHeaderLen}, make([]byte, ctlHeaderLen)); err != nil {
+		t.Errorf("full write: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package ntp
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvHeader names the columns written by WriteCSV.
+var csvHeader = []string{"timestamp", "server", "offset", "delay", "rtt", "stratum", "root_distance", "error"}
+
+// WriteCSV writes samples to w as CSV, one row per sample after a header
+// row naming the columns: the time the request was sent in RFC 3339
+// format, the server address, the offset, delay, round trip time and root
+// distance in seconds, the stratum, and the error of failed queries.
+func WriteCSV(w io.Writer, samples []Sample) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+
+	for _, s := range samples {
+		if s.Err != nil {
+			cw.Write([]string{"", "", "", "", "", "", "", s.Err.Error()})
+			continue
+		}
+		st := s.Stats
+		server := ""
+		if st.RemoteAddr != nil {
+			server = st.RemoteAddr.String()
+		}
+		cw.Write([]string{
+			st.OriginTime.UTC().Format(time.RFC3339Nano),
+			server,
+			csvSeconds(st.Offset),
+			csvSeconds(st.Delay),
+			csvSeconds(st.DestinationTime.Sub(st.OriginTime)),
+			strconv.Itoa(int(st.Stratum)),
+			csvSeconds(st.RootDistance()),
+			"",
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,36 @@
+package ntp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteCSV(t *testing.T) {
+	samples := []Sample{
+		{Stats: NtpStats{
+			OriginTime:      t0,
+			DestinationTime: t0.Add(24 * ms),
+			RemoteAddr:      &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123},
+			Offset:          -1500 * time.Microsecond,
+			Delay:           20 * ms,
+			Stratum:         2,
+			RootDelay:       10 * ms,
+			RootDispersion:  5 * ms,
+		}},
+		{Err: errors.New("read: i/o timeout, retrying")},
+	}
+	const want = "timestamp,server,offset,delay,rtt,stratum,root_distance,error\n" +
+		"2026-10-14T12:00:00Z,192.0.2.1:123,-0.0015,0.02,0.024,2,0.02,\n" +
+		",,,,,,,\"read: i/o timeout, retrying\"\n"
+
+	var b bytes.Buffer
+	if err := WriteCSV(&b, samples); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package ntp
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the don't fragment bit on packets sent through c,
+// so that packets too large for the path fail with EMSGSIZE instead of
+// being fragmented.
+func setDontFragment(c *net.UDPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	level, opt, val := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		level, opt, val = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, val)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
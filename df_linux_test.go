@@ -0,0 +1,56 @@
+//go:build linux
+
+package ntp
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDontFragment(t *testing.T) {
+	mtuDiscover := func(c *net.UDPConn, level, opt int) int {
+		t.Helper()
+		rc, err := c.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var val int
+		var gerr error
+		if err := rc.Control(func(fd uintptr) {
+			val, gerr = syscall.GetsockoptInt(int(fd), level, opt)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if gerr != nil {
+			t.Fatal(gerr)
+		}
+		return val
+	}
+
+	tests := []struct {
+		ip         net.IP
+		level, opt int
+		want       int
+	}{
+		{net.IPv4(127, 0, 0, 1), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO},
+		{net.IPv6loopback, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO},
+	}
+	for _, tt := range tests {
+		raddr := &net.UDPAddr{IP: tt.ip, Port: closedPort(t)}
+		con, err := dial(context.Background(), raddr, QueryOptions{DontFragment: true}, time.Now().Add(time.Second))
+		if err != nil {
+			if tt.ip.To4() == nil {
+				t.Logf("skipping IPv6: %v", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		if got := mtuDiscover(con.UDPConn, tt.level, tt.opt); got != tt.want {
+			t.Errorf("%v: MTU discovery = %d, want %d", tt.ip, got, tt.want)
+		}
+		con.Close()
+	}
+}
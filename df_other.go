@@ -0,0 +1,12 @@
+//go:build !linux
+
+package ntp
+
+import (
+	"errors"
+	"net"
+)
+
+func setDontFragment(c *net.UDPConn) error {
+	return errors.New("don't fragment not supported on this platform")
+}
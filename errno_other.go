@@ -0,0 +1,24 @@
+//go:build !plan9
+
+package ntp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isRefused reports whether err says no server listens on the port.
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// isUnreachable reports whether err says the server cannot be reached.
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// isTooLarge reports whether err says a packet exceeded the path MTU.
+func isTooLarge(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
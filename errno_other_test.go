@@ -0,0 +1,82 @@
+//go:build !plan9
+
+package ntp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+// resetConn is a PacketConn whose reads fail as a socket whose flow was
+// reset by the server does.
+type resetConn struct{ net.PacketConn }
+
+func (c resetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNRESET)}
+}
+
+func TestServerUnreachable(t *testing.T) {
+	con, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: closedPort(t)}
+	_, err = QueryPacketConn(resetConn{con}, raddr, QueryOptions{})
+	var te *TransportError
+	if !errors.As(err, &te) || te.Phase != "read" || !errors.Is(err, ErrServerUnreachable) {
+		t.Errorf("reset on read: err = %v, want a read error matching ErrServerUnreachable", err)
+	}
+	if errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("reset on read matched ErrConnectionRefused")
+	}
+
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		err := &TransportError{"read", &net.OpError{Op: "read", Err: os.NewSyscallError("read", errno)}}
+		if !errors.Is(err, ErrServerUnreachable) {
+			t.Errorf("%v does not match ErrServerUnreachable", errno)
+		}
+	}
+	if errors.Is(&TransportError{"read", os.ErrDeadlineExceeded}, ErrServerUnreachable) {
+		t.Error("a timeout matched ErrServerUnreachable")
+	}
+}
+
+func TestClientRecovers(t *testing.T) {
+	// The server is down for the first query, which fails at once where
+	// the stack reports the refusal and after the timeout elsewhere.
+	port := closedPort(t)
+	c := &Client{Host: "127.0.0.1", Options: QueryOptions{Port: port, Timeout: 100 * ms}, MinInterval: time.Millisecond}
+	if _, err := c.Query(); err == nil {
+		t.Fatal("query of a server that is down succeeded")
+	}
+
+	s, err := ntptest.NewServerAt("127.0.0.1:"+strconv.Itoa(port), ntptest.Reply{Stratum: 2})
+	if err != nil {
+		t.Skipf("cannot listen on port %d again: %v", port, err)
+	}
+	defer s.Close()
+	if _, err := c.Query(); err != nil {
+		t.Errorf("query once the server is back: %v", err)
+	}
+}
+
+func TestPacketTooLarge(t *testing.T) {
+	err := error(&TransportError{"write", &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.EMSGSIZE)}})
+	if !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("EMSGSIZE on write: %v does not match ErrPacketTooLarge", err)
+	}
+	if errors.Is(err, ErrServerUnreachable) || errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("EMSGSIZE on write matched an unreachable server")
+	}
+	if errors.Is(&TransportError{"write", os.ErrDeadlineExceeded}, ErrPacketTooLarge) {
+		t.Error("a timeout matched ErrPacketTooLarge")
+	}
+}
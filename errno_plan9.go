@@ -0,0 +1,8 @@
+package ntp
+
+// Plan 9 reports network errors as strings, not errnos, so refused,
+// unreachable and oversized packets are not told apart.
+
+func isRefused(err error) bool     { return false }
+func isUnreachable(err error) bool { return false }
+func isTooLarge(err error) bool    { return false }
@@ -0,0 +1,52 @@
+package ntp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ServerStats pairs the stats of a query with the server it was sent to,
+// for WritePrometheus.
+type ServerStats struct {
+	Server string
+	Stats  NtpStats
+}
+
+// WritePrometheus writes the stats of each server to w in the Prometheus
+// text exposition format, each metric family once with a sample per
+// server.  Samples are labelled with the server unless it is empty.  The
+// metrics written are ntp_offset_seconds, ntp_delay_seconds, ntp_stratum,
+// ntp_root_delay_seconds, ntp_root_dispersion_seconds and
+// ntp_root_distance_seconds, all gauges.
+func WritePrometheus(w io.Writer, servers []ServerStats) error {
+	metrics := []struct {
+		name, help string
+		value      func(s NtpStats) float64
+	}{
+		{"ntp_offset_seconds", "Offset of the local clock from the server.", func(s NtpStats) float64 { return s.Offset.Seconds() }},
+		{"ntp_delay_seconds", "Round trip delay to the server.", func(s NtpStats) float64 { return s.Delay.Seconds() }},
+		{"ntp_stratum", "Stratum of the server.", func(s NtpStats) float64 { return float64(s.Stratum) }},
+		{"ntp_root_delay_seconds", "Round trip delay from the server to its reference clock.", func(s NtpStats) float64 { return s.RootDelay.Seconds() }},
+		{"ntp_root_dispersion_seconds", "Dispersion of the server relative to its reference clock.", func(s NtpStats) float64 { return s.RootDispersion.Seconds() }},
+		{"ntp_root_distance_seconds", "Estimated maximum error of the offset.", func(s NtpStats) float64 { return s.RootDistance().Seconds() }},
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		bw.WriteString("# HELP " + m.name + " " + m.help + "\n")
+		bw.WriteString("# TYPE " + m.name + " gauge\n")
+		for _, s := range servers {
+			labels := ""
+			if s.Server != "" {
+				labels = `{server="` + labelEscaper.Replace(s.Server) + `"}`
+			}
+			bw.WriteString(m.name + labels + " " + strconv.FormatFloat(m.value(s.Stats), 'g', -1, 64) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// labelEscaper escapes label values as the exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
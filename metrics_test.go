@@ -0,0 +1,61 @@
+package ntp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	servers := []ServerStats{
+		{"pool.example", NtpStats{Offset: 1500 * time.Microsecond, Delay: 20 * ms, Stratum: 2, RootDelay: 10 * ms, RootDispersion: 5 * ms}},
+		{"odd\"name\\\n", NtpStats{Offset: -250 * time.Microsecond, Delay: 4 * ms, Stratum: 1, RootDispersion: 500 * time.Microsecond}},
+		{"", NtpStats{Stratum: 3}},
+	}
+	const want = `# HELP ntp_offset_seconds Offset of the local clock from the server.
+# TYPE ntp_offset_seconds gauge
+ntp_offset_seconds{server="pool.example"} 0.0015
+ntp_offset_seconds{server="odd\"name\\\n"} -0.00025
+ntp_offset_seconds 0
+# HELP ntp_delay_seconds Round trip delay to the server.
+# TYPE ntp_delay_seconds gauge
+ntp_delay_seconds{server="pool.example"} 0.02
+ntp_delay_seconds{server="odd\"name\\\n"} 0.004
+ntp_delay_seconds 0
+# HELP ntp_stratum Stratum of the server.
+# TYPE ntp_stratum gauge
+ntp_stratum{server="pool.example"} 2
+ntp_stratum{server="odd\"name\\\n"} 1
+ntp_stratum 3
+# HELP ntp_root_delay_seconds Round trip delay from the server to its reference clock.
+# TYPE ntp_root_delay_seconds gauge
+ntp_root_delay_seconds{server="pool.example"} 0.01
+ntp_root_delay_seconds{server="odd\"name\\\n"} 0
+ntp_root_delay_seconds 0
+# HELP ntp_root_dispersion_seconds Dispersion of the server relative to its reference clock.
+# TYPE ntp_root_dispersion_seconds gauge
+ntp_root_dispersion_seconds{server="pool.example"} 0.005
+ntp_root_dispersion_seconds{server="odd\"name\\\n"} 0.0005
+ntp_root_dispersion_seconds 0
+# HELP ntp_root_distance_seconds Estimated maximum error of the offset.
+# TYPE ntp_root_distance_seconds gauge
+ntp_root_distance_seconds{server="pool.example"} 0.02
+ntp_root_distance_seconds{server="odd\"name\\\n"} 0.0025
+ntp_root_distance_seconds 0
+`
+	var b bytes.Buffer
+	if err := WritePrometheus(&b, servers); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestWritePrometheusError(t *testing.T) {
+	broken := errors.New("broken pipe")
+	if err := WritePrometheus(failingWriter{broken}, []ServerStats{{"a", NtpStats{}}}); err != broken {
+		t.Errorf("err = %v, want the writer's", err)
+	}
+}
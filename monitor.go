@@ -0,0 +1,77 @@
+package ntp
+
+import (
+	"context"
+	"time"
+)
+
+// monitorBuffer is the capacity of a Monitor's results channel.
+const monitorBuffer = 16
+
+// A Monitor queries a server in the background and publishes each sample
+// on a channel, for consumers built around select loops.
+type Monitor struct {
+	client  *Client
+	results chan Sample
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewMonitor starts querying host every interval.  The caller must call
+// Stop when finished.
+func NewMonitor(host string, interval time.Duration, opt QueryOptions) *Monitor {
+	return NewClientMonitor(&Client{Host: host, Options: opt, MinInterval: interval})
+}
+
+// NewClientMonitor starts querying with c, as often as it allows, so that
+// its session settings such as OnServerChange and StratumIncrease apply.
+// c must not be used elsewhere until the Monitor is stopped.  The caller
+// must call Stop when finished.
+func NewClientMonitor(c *Client) *Monitor {
+	m := &Monitor{
+		client:  c,
+		results: make(chan Sample, monitorBuffer),
+		done:    make(chan struct{}),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go m.run()
+	return m
+}
+
+// Results returns the channel on which samples are published.  It is
+// closed once the Monitor has stopped.  The Monitor waits for the
+// consumer when the channel is full.
+func (m *Monitor) Results() <-chan Sample {
+	return m.results
+}
+
+// Stop stops the Monitor, abandoning any query in progress, and waits for
+// its goroutine to exit.
+func (m *Monitor) Stop() {
+	m.cancel()
+	<-m.done
+}
+
+func (m *Monitor) run() {
+	defer close(m.done)
+	defer close(m.results)
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(m.client.wait()):
+		}
+
+		s := Sample{}
+		s.Stats, s.Err = m.client.QueryContext(m.ctx)
+		if m.ctx.Err() != nil {
+			return
+		}
+		select {
+		case m.results <- s:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package ntp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestMonitor(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2, Offset: 5 * ms})
+	m := NewMonitor(s.Host, time.Millisecond, QueryOptions{Port: s.Port})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case smp := <-m.Results():
+			if smp.Err != nil || smp.Stats.Stratum != 2 {
+				t.Fatalf("sample %d: stratum %d, err %v", i, smp.Stats.Stratum, smp.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a sample")
+		}
+	}
+
+	m.Stop()
+	// The channel is closed once the samples already buffered are read.
+	timeout := time.After(time.Second)
+	for n := 0; ; n++ {
+		select {
+		case _, ok := <-m.Results():
+			if !ok {
+				return
+			}
+			if n > monitorBuffer {
+				t.Fatalf("more than %d samples after Stop", monitorBuffer)
+			}
+		case <-timeout:
+			t.Fatal("results channel not closed after Stop")
+		}
+	}
+}
+
+func TestMonitorStopUnread(t *testing.T) {
+	// With nobody reading, the buffer fills and the Monitor blocks, which
+	// Stop must not wait out.
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	m := NewMonitor(s.Host, time.Millisecond, QueryOptions{Port: s.Port})
+	time.Sleep(100 * ms)
+
+	done := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
+
+func TestClientMonitorStratumIncrease(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	s.SetReplies(ntptest.Reply{Stratum: 1}, ntptest.Reply{Stratum: 1}, ntptest.Reply{Stratum: 3})
+	m := NewClientMonitor(&Client{
+		Host:                  s.Host,
+		Options:               QueryOptions{Port: s.Port},
+		MinInterval:           time.Millisecond,
+		StratumIncrease:       1,
+		RejectStratumIncrease: true,
+	})
+	defer m.Stop()
+
+	for i, want := range []error{nil, nil, ErrStratumIncreased, ErrStratumIncreased} {
+		select {
+		case smp := <-m.Results():
+			if smp.Err != want {
+				t.Errorf("sample %d: err = %v, want %v", i, smp.Err, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a sample")
+		}
+	}
+}
@@ -1,32 +1,150 @@
 // Package ntp provides a simple mechanism for querying the current time
-// from a remote NTP server.  This package only supports NTP client mode
-// behavior and version 4 of the NTP protocol.  See RFC 5905.
+// from a remote NTP server.  This package primarily supports NTP client
+// mode behavior and version 4 of the NTP protocol, with version 3 as an
+// option.  See RFC 5905.
 // Approach inspired by go-nuts post by Michael Hofmann:
 // https://groups.google.com/forum/?fromgroups#!topic/golang-nuts/FlcdMU5fkLQ
 
 package ntp
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"math"
+	"math/rand"
 	"net"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
-type mode byte
+// ErrShortWrite is wrapped in the error returned when the request packet
+// could not be sent in full.  The query may be retried.
+var ErrShortWrite = errors.New("short write of request packet")
+
+// ErrConnectionRefused matches, using errors.Is, the error of a query to
+// a host that answered with an ICMP port unreachable message, meaning no
+// NTP server is listening.  Linux and the BSDs report this on the read
+// following the ICMP message; other platforms, notably Windows, may not
+// surface it, in which case the query fails with a timeout instead.
+var ErrConnectionRefused = errors.New("connection refused: no NTP server listening")
+
+// ErrServerUnreachable matches, using errors.Is, the error of a query
+// whose socket reported the server unreachable: the flow was reset, the
+// host or network is unreachable, or the connection was refused.  Some
+// stacks report a reset on the read after a server stops answering.
+// Every query uses a new socket, so a Client simply recovers on its next
+// query if the server is back.
+var ErrServerUnreachable = errors.New("server unreachable")
+
+// ErrPacketTooLarge matches, using errors.Is, the error of a query with
+// DontFragment set whose packets are too large for the path to the
+// server, as learnt from ICMP fragmentation needed messages.
+var ErrPacketTooLarge = errors.New("packet too large for path MTU")
+
+// A TransportError is returned when the network operations of a query
+// fail.  Phase is the step that failed: "resolve", "dial", "write" or
+// "read".  Err is the underlying error, usually a *net.OpError or for
+// the resolve phase a *net.DNSError.
+type TransportError struct {
+	Phase string
+	Err   error
+}
+
+func (e *TransportError) Error() string {
+	return "ntp " + e.Phase + ": " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports a refused connection as ErrConnectionRefused, an unreachable
+// server as ErrServerUnreachable and a packet exceeding the path MTU as
+// ErrPacketTooLarge.
+func (e *TransportError) Is(target error) bool {
+	switch target {
+	case ErrConnectionRefused:
+		return isRefused(e.Err)
+	case ErrServerUnreachable:
+		return isUnreachable(e.Err)
+	case ErrPacketTooLarge:
+		return isTooLarge(e.Err)
+	}
+	return false
+}
+
+// ErrBogusPacket is returned when a reply's origin timestamp does not
+// match the transmit timestamp of the request, so it does not answer it.
+// ErrDuplicatePacket is returned when a reply carries the same transmit
+// timestamp as the previous reply processed from the server, making it a
+// copy of that reply.  See RFC 5905 section 8.
+var (
+	ErrBogusPacket     = errors.New("received bogus packet")
+	ErrDuplicatePacket = errors.New("received duplicate packet")
+)
+
+// ErrFutureTimestamp is returned when the server's timestamps are later
+// than QueryOptions.MaxTime, a sign of a badly broken server clock.
+var ErrFutureTimestamp = errors.New("server timestamp too far in the future")
+
+// ErrUnsynchronizedServer is returned when the server replies with
+// stratum 16, meaning it is running but not yet synchronized.  Such a
+// server may be worth retrying later.
+var ErrUnsynchronizedServer = errors.New("server is not synchronized")
+
+// A KissOfDeathError is returned when the server replies with stratum 0,
+// a kiss-o'-death packet.  Code is the four character kiss code, such as
+// "RATE" when the client should reduce its query rate or "DENY" when it
+// should stop querying the server.  See RFC 5905 section 7.4.
+type KissOfDeathError struct {
+	Code string
+}
+
+func (e *KissOfDeathError) Error() string {
+	return "kiss of death received: " + e.Code
+}
+
+// A Mode is the association mode of an NTP packet, held in the low
+// three bits of its first byte.
+type Mode byte
 
 const (
-	reserved mode = 0 + iota
-	symmetricActive
-	symmetricPassive
-	client
-	server
-	broadcast
-	controlMessage
-	reservedPrivate
+	ModeReserved Mode = 0 + iota
+	ModeSymmetricActive
+	ModeSymmetricPassive
+	ModeClient
+	ModeServer
+	ModeBroadcast
+	ModeControl // mode 6 control messages
+	ModePrivate // reserved for private use
 )
 
+var modeNames = [...]string{
+	ModeReserved:         "reserved",
+	ModeSymmetricActive:  "symmetric active",
+	ModeSymmetricPassive: "symmetric passive",
+	ModeClient:           "client",
+	ModeServer:           "server",
+	ModeBroadcast:        "broadcast",
+	ModeControl:          "control",
+	ModePrivate:          "private",
+}
+
+func (md Mode) String() string {
+	if int(md) < len(modeNames) {
+		return modeNames[md]
+	}
+	return "Mode(" + strconv.Itoa(int(md)) + ")"
+}
+
 type ntpTime struct {
 	Seconds  uint32
 	Fraction uint32
@@ -35,23 +153,311 @@ type ntpTime struct {
 type NtpStats struct {
 	Delay  time.Duration
 	Offset time.Duration
+
+	// ServerProcessingDelay is how long the server held the request,
+	// its transmit time minus its receive time.  A consistently large
+	// value suggests an overloaded server.
+	ServerProcessingDelay time.Duration
+
+	// CoarseClock is set when the local wall clock read the same time
+	// when the request was sent and the reply received, meaning its
+	// resolution is too coarse to measure the exchange.  Delay is then
+	// zero unless the monotonic clock measured it.  For live queries
+	// ClockResolution is an estimate of the wall clock's resolution,
+	// which RootDistance includes.
+	CoarseClock     bool
+	ClockResolution time.Duration
+
+	// SingleStamp is set when the reply's receive and transmit times
+	// are the same, the server stamping it once, or with
+	// QueryOptions.SingleStamp when it left the receive time zero.  The
+	// usual formulas then reduce to measuring against that one stamp,
+	// and the server's processing time counts as network delay: the
+	// offset is off by up to half of it, depending on when in its
+	// processing the server took the stamp.
+	SingleStamp bool
+
+	Leap           byte // leap indicator: 1 or 2 for a pending leap second, 3 for alarm
+	Mode           Mode // mode of the reply, ModeServer unless malformed
+	Version        byte // NTP version of the reply
+	Stratum        byte
+	ReferenceID    uint32
+	Poll           time.Duration // server's advertised poll interval
+	Precision      time.Duration // resolution of the server's clock
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+
+	// VersionMismatch is set when the reply's version differs from the
+	// request's, the server ignoring the version asked for.
+	VersionMismatch bool
+
+	// TransmitBeforeRef is set when the server's transmit time is earlier
+	// than its reference time, a sign of a clock anomaly at the server.
+	// Strict queries also fail with ErrTransmitBeforeRef, or with
+	// BestEffort report it in Warnings.
+	TransmitBeforeRef bool
+
+	LocalAddr  net.Addr // local address the query was sent from
+	RemoteAddr net.Addr // address of the server that replied
+
+	// ReplyLen is the size of the reply packet in bytes and
+	// ReplyChecksum its IEEE CRC-32, for spotting duplicates and
+	// corruption in logs.
+	ReplyLen      int
+	ReplyChecksum uint32
+
+	// Class classifies the reply by its length.  Truncated is set when
+	// the reply was longer than QueryOptions.MaxReplyLen, so that only
+	// its first MaxReplyLen bytes were read, and ReplyLen and
+	// ReplyChecksum cover those; such a reply carries extension fields.
+	Class     PacketClass
+	Truncated bool
+
+	// RequestPacket is the request exactly as sent, MAC included.
+	RequestPacket []byte
+
+	// Warnings lists the checks the reply failed that a BestEffort query
+	// tolerated.
+	Warnings []error
+
+	// Broadcast is set for stats from a broadcast packet rather than a
+	// request and reply.  Their offset is not corrected for network
+	// delay and has no round trip to validate it.
+	Broadcast bool
+
+	// ServerError is how far the server's clock is ahead of the
+	// reference clock of QueryOptions.Reference, and zero if none was
+	// given.  Offset minus ServerError is then the error of the local
+	// clock against the reference.
+	ServerError time.Duration
+
+	// TAIOffset is what to add to the local clock, assumed to keep UTC,
+	// to get TAI: Offset plus TAI-UTC from QueryOptions.LeapTable.  It
+	// is zero if no table was given.
+	TAIOffset time.Duration
+
+	// FallbackAddr is set when, with QueryOptions.Fallback, the reply
+	// came from an address other than the first one tried, and
+	// Downgraded when, with QueryOptions.Downgrade, it was only obtained
+	// by retrying with version 3.
+	FallbackAddr bool
+	Downgraded   bool
+
+	ReferenceTime   time.Time // server clock last set or corrected
+	OriginTime      time.Time // T1: client sent request
+	ReceiveTime     time.Time // T2: server got request
+	TransmitTime    time.Time // T3: server sent reply
+	DestinationTime time.Time // T4: client got reply
+
+	// The timestamps of the reply as sent, for re-encoding without loss.
+	RawReferenceTime Timestamp
+	RawOriginTime    Timestamp
+	RawReceiveTime   Timestamp
+	RawTransmitTime  Timestamp
+}
+
+// log2ToDuration converts a power of two exponent in seconds, as used by
+// the poll and precision fields, to a time.Duration, saturating at the
+// longest Duration for exponents of 34 and above.
+func log2ToDuration(e int8) time.Duration {
+	return nsToDuration(math.Pow(2, float64(e)) * 1e9)
+}
+
+// nsToDuration converts a non-negative number of nanoseconds to a
+// time.Duration, saturating at the longest Duration rather than
+// overflowing.
+func nsToDuration(ns float64) time.Duration {
+	if ns >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(ns)
+}
+
+// ShortToDuration converts a value in the NTP short format, 16.16 fixed
+// point seconds as used by the root delay and dispersion fields, to a
+// time.Duration.  0x00010000 is one second.
+func ShortToDuration(v uint32) time.Duration {
+	return time.Duration(uint64(v) * 1e9 >> 16)
+}
+
+// DurationToShort converts d to the NTP short format, rounding to its
+// resolution of about 15 microseconds, so that it inverts
+// ShortToDuration.  Durations outside the format's range of 0 to 65536
+// seconds are clamped to it.
+func DurationToShort(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	if d >= 65536*time.Second {
+		return math.MaxUint32
+	}
+	v := (uint64(d)<<16 + 5e8) / 1e9
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
+
+// OffsetSeconds returns the offset in seconds.
+func (s NtpStats) OffsetSeconds() float64 {
+	return s.Offset.Seconds()
+}
+
+// DelaySeconds returns the round trip delay in seconds.
+func (s NtpStats) DelaySeconds() float64 {
+	return s.Delay.Seconds()
 }
 
+// OneWayDelay returns half of the round trip delay.  This assumes the
+// outbound and inbound network paths are symmetric, which is the same
+// assumption the offset calculation makes; on asymmetric links the true
+// one-way delay in either direction can differ substantially.
+func (s NtpStats) OneWayDelay() time.Duration {
+	return s.Delay / 2
+}
+
+// RootDistance returns the estimated maximum error of the offset relative
+// to the primary reference source at the root of the server's
+// synchronization subnet.  See RFC 5905 section 10.
+func (s NtpStats) RootDistance() time.Duration {
+	return (s.RootDelay+s.Delay)/2 + s.RootDispersion + s.ClockResolution
+}
+
+// Score rates the quality of the response, lower being better, as the
+// stratum times the largest acceptable root distance of 1.5 seconds plus
+// the root distance, which includes half the round trip delay.  This is
+// the metric RFC 5905 uses to rank servers, so a lower stratum always
+// wins and root distance decides among servers of equal stratum.
+func (s NtpStats) Score() time.Duration {
+	return time.Duration(s.Stratum)*maxRootDistance + s.RootDistance()
+}
+
+// InAgreement reports whether the local clock agrees with the server
+// within the error of the measurement: whether the magnitude of the
+// offset is at most the root distance, which includes half the round
+// trip delay.
+func (s NtpStats) InAgreement() bool {
+	return abs(s.Offset) <= s.RootDistance()
+}
+
+// Asymmetry returns the outbound (client to server) transit time minus the
+// inbound one, given the true offset of the local clock.  One-way delays
+// are not observable from the timestamps alone: any asymmetry is
+// indistinguishable from offset, so trueOffset must come from an
+// independent reference.  With trueOffset set to the measured Offset the
+// result is always zero.  Errors in trueOffset appear doubled.
+func (s NtpStats) Asymmetry(trueOffset time.Duration) time.Duration {
+	out := s.ReceiveTime.Sub(s.OriginTime) - trueOffset
+	in := s.DestinationTime.Sub(s.TransmitTime) + trueOffset
+	return out - in
+}
+
+// maxDrift is the frequency tolerance assumed for server clocks, 15 ppm
+// as in RFC 5905.
+const maxDrift = 15e-6
+
+// EffectiveDispersion returns the root dispersion grown by the drift the
+// server's clock may have accumulated since it was last synchronized: its
+// precision plus 15 ppm of the time from its reference time to its
+// transmit time.  This gives a more honest error bound for servers that
+// have not synchronized for a while.
+func (s NtpStats) EffectiveDispersion() time.Duration {
+	age := s.TransmitTime.Sub(s.ReferenceTime)
+	if s.ReferenceTime.Year() < 1970 || age < 0 { // unset
+		age = 0
+	}
+	return nsToDuration(float64(s.RootDispersion) + float64(s.Precision) + maxDrift*float64(age))
+}
+
+// Noise returns an estimate of the measurement noise of the sample: the
+// server's clock precision and its root dispersion, taken as independent
+// errors and combined as the root of the sum of their squares.
+func (s NtpStats) Noise() time.Duration {
+	p, d := s.Precision.Seconds(), s.RootDispersion.Seconds()
+	return nsToDuration(math.Sqrt(p*p+d*d) * 1e9)
+}
+
+// Now returns the current local time corrected by the offset.  The
+// result keeps the monotonic clock reading of time.Now, so differences
+// between times returned by Now on the same stats measure elapsed time
+// exactly, unaffected by steps of the wall clock.  Comparisons between
+// results from different stats include the difference of their offsets.
+// Call Round(0) on the result to strip the monotonic reading.
+func (s NtpStats) Now() time.Time {
+	return time.Now().Add(s.Offset)
+}
+
+// CorrectedOriginTime returns the corrected time at which the request was
+// sent: the local origin time plus the offset, the reading a correct
+// clock would have given then.  Unlike Now it depends only on the stats,
+// so it gives the same instant for samples stored and reloaded.
+func (s NtpStats) CorrectedOriginTime() time.Time {
+	return s.OriginTime.Add(s.Offset)
+}
+
+// Interval returns the confidence interval of the offset: the offset plus
+// or minus the root distance.  The true offset of the local clock lies
+// within it as long as the server is correct.
+func (s NtpStats) Interval() (lo, hi time.Duration) {
+	d := s.RootDistance()
+	return s.Offset - d, s.Offset + d
+}
+
+// UTC returns the time t represents.  The 32 bit seconds field wraps in
+// 2036, so timestamps with the high bit clear are taken to be in era 1,
+// from 2036 to 2104, and others in era 0, from 1968; the all-zero
+// timestamp, which NTP uses for an unknown time, maps to 1900.
 func (t ntpTime) UTC() time.Time {
-	nsec := uint64(t.Seconds)*1e9 + (uint64(t.Fraction) * 1e9 >> 32)
-	return time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(nsec))
+	secs := uint64(t.Seconds)
+	if secs&0x80000000 == 0 && t != (ntpTime{}) {
+		secs += 1 << 32
+	}
+	epoch := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	return epoch.Add(time.Duration(secs) * time.Second).Add(time.Duration((uint64(t.Fraction)*1e9 + 1<<31) >> 32))
 }
 
+// ntpEpochOffset is the number of seconds from the NTP epoch, 1900, to
+// the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// toNtpTime converts t to an NTP timestamp, rounding to the nearest
+// fraction.  The seconds wrap at the era boundary.
 func toNtpTime(t time.Time) ntpTime {
-	epoch := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
-	d := t.Sub(epoch)
-	i, f := math.Modf(d.Seconds())
+	return ntpTime{
+		Seconds:  uint32(t.Unix() + ntpEpochOffset),
+		Fraction: uint32((uint64(t.Nanosecond())<<32 + 5e8) / 1e9),
+	}
+}
+
+// A Timestamp is a raw 64 bit NTP timestamp: seconds since the start of
+// the era in the high 32 bits and the fraction of a second in the low 32.
+type Timestamp uint64
 
-	n := new(ntpTime)
-	n.Seconds = uint32(i)
-	n.Fraction = uint32(f * math.Pow(2, 32)) // fraction * uint32 max value
+// Time returns the time t represents, choosing the era as NTPToTime does.
+func (t Timestamp) Time() time.Time {
+	return ntpTime{uint32(t >> 32), uint32(t)}.UTC()
+}
+
+func (t ntpTime) raw() Timestamp {
+	return Timestamp(t.Seconds)<<32 | Timestamp(t.Fraction)
+}
 
-	return *n
+// TimeToNTP encodes t as a 64 bit NTP timestamp in network byte order.
+// Only the position of t within its 136 year era is kept.
+func TimeToNTP(t time.Time) [8]byte {
+	n := toNtpTime(t)
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], n.Seconds)
+	binary.BigEndian.PutUint32(b[4:], n.Fraction)
+	return b
+}
+
+// NTPToTime decodes a 64 bit NTP timestamp in network byte order.  The
+// era is chosen so that the result falls between 1968 and 2104, except
+// for the all-zero timestamp which decodes to 1900-01-01.
+func NTPToTime(b [8]byte) time.Time {
+	n := ntpTime{binary.BigEndian.Uint32(b[:4]), binary.BigEndian.Uint32(b[4:])}
+	return n.UTC()
 }
 
 type msg struct {
@@ -74,7 +480,7 @@ func (m *msg) SetVersion(v byte) {
 }
 
 // SetMode sets the NTP protocol mode on the message.
-func (m *msg) SetMode(md mode) {
+func (m *msg) SetMode(md Mode) {
 	m.LiVnMode = (m.LiVnMode & 0xf8) | byte(md)
 }
 
@@ -86,52 +492,958 @@ func (m *msg) SetTransmitTime(t ntpTime) {
 	m.TransmitTime = t
 }
 
+// refIDString returns the reference ID as four ASCII characters with
+// trailing NULs removed, as used by kiss codes and stratum 1 reference
+// identifiers.
+func refIDString(id uint32) string {
+	b := []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// headerLen is the length of an NTP packet without extension fields or
+// MAC.
+const headerLen = 48
+
+// parsePacket decodes the NTP header at the start of b.  It checks that b
+// is long enough, that anything following the header is a whole number of
+// 32 bit words as extension fields and MACs are, and that the version is
+// one that exists.
+func parsePacket(b []byte) (*msg, error) {
+	if len(b) < headerLen {
+		return nil, errors.New("short packet")
+	}
+	if (len(b)-headerLen)%4 != 0 {
+		return nil, errors.New("malformed packet trailer")
+	}
+
+	m := new(msg)
+	binary.Read(bytes.NewReader(b[:headerLen]), binary.BigEndian, m)
+	if v := (m.LiVnMode >> 3) & 0x07; v < 1 || v > 4 {
+		return nil, errors.New("invalid packet version")
+	}
+	return m, nil
+}
+
+// A PacketClass tells what follows the header of an NTP packet.
+type PacketClass int
+
+const (
+	PacketPlain         PacketClass = iota // the 48 byte header alone
+	PacketAuthenticated                    // the header and a MAC or crypto-NAK
+	PacketExtended                         // extension fields, possibly with a MAC
+	PacketShort                            // shorter than the header
+)
+
+func (c PacketClass) String() string {
+	switch c {
+	case PacketPlain:
+		return "plain"
+	case PacketAuthenticated:
+		return "authenticated"
+	case PacketExtended:
+		return "extended"
+	case PacketShort:
+		return "short"
+	}
+	return "PacketClass(" + strconv.Itoa(int(c)) + ")"
+}
+
+// ClassifyPacket classifies the packet b by its length, following RFC
+// 7822: 4, 20 or 24 bytes after the header are a crypto-NAK or an MD5 or
+// SHA-1 MAC, and any other trailer holds extension fields.  Packets
+// shorter than the 48 byte header are PacketShort.
+func ClassifyPacket(b []byte) PacketClass {
+	if len(b) < headerLen {
+		return PacketShort
+	}
+	switch len(b) - headerLen {
+	case 0:
+		return PacketPlain
+	case 4, 20, 24:
+		return PacketAuthenticated
+	}
+	return PacketExtended
+}
+
+// writeMsg sends m to w as a single write, followed by a MAC if key is
+// not nil, failing with ErrShortWrite unless the whole packet was
+// written.  It returns the packet.
+func writeMsg(w io.Writer, m *msg, key *SymmetricKey) ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, m)
+	if key != nil {
+		buf.Write(key.mac(buf.Bytes()))
+	}
+
+	if err := writePacket(w, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writePacket sends b to w as a single write, failing with ErrShortWrite
+// unless all of it was written.
+func writePacket(w io.Writer, b []byte) error {
+	n, err := w.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return ErrShortWrite
+	}
+	return nil
+}
+
+// QueryOptions contains the configurable parameters of a query.  The zero
+// value gives the same behavior as Request.
+type QueryOptions struct {
+	// TransmitTime, if non-zero, is sent as the request transmit time
+	// instead of the current time, making the outgoing packet
+	// reproducible.  Replies are validated against it, but delay and
+	// offset are still computed from the local clock.  The unpredictable
+	// transmit time is what stops an off-path attacker forging replies,
+	// so only use this in tests.
+	TransmitTime time.Time
+
+	// Poll and Precision are sent in the request's poll and precision
+	// fields, as base 2 logarithms of seconds: a Poll of 6 advertises a
+	// 64 second poll interval, a Precision of -20 about a microsecond.
+	Poll      int8
+	Precision int8
+
+	// Concurrency limits the number of queries outstanding at once in
+	// functions querying several servers.  If zero, 16 is used.
+	Concurrency int
+
+	// RandomAddr makes the query go to an address chosen at random among
+	// those host resolves to, rather than the first, spreading load
+	// across the members of a pool.
+	RandomAddr bool
+
+	// Port is the UDP port of the server.  If zero, 123 is used, or
+	// with LookupPort set the port of the "ntp" service in the system's
+	// services database, falling back to 123 if it has none.
+	Port       int
+	LookupPort bool
+
+	// LocalAddr, if set, is the local address queries are sent from,
+	// selecting the interface on multi-homed hosts.  Its port is usually
+	// left zero.
+	LocalAddr *net.UDPAddr
+
+	// Timeout bounds the exchange of packets in each attempt at the
+	// query.  If zero, 5 seconds is used.
+	Timeout time.Duration
+
+	// ResolveTimeout bounds the resolution of the host name in each
+	// attempt, separately from Timeout.  If zero, Timeout is used.
+	ResolveTimeout time.Duration
+
+	// Retries is the number of times a failed query is attempted again.
+	// Queries refused with a kiss-o'-death are not retried.
+	Retries int
+
+	// TotalBudget, if non-zero, bounds the whole query, all retries and
+	// addresses included.  When it runs out the error of the last
+	// attempt is returned; the first attempt is always made, failing with
+	// a timeout if the budget is already spent.
+	TotalBudget time.Duration
+
+	// Fallback makes a failed query move on to the next address host
+	// resolves to, until one answers or all have been tried.  Each
+	// address gets AddrTimeout, or if that is zero an even share of what
+	// remains of the attempt's Timeout, so dead pool members cannot
+	// exhaust it.
+	Fallback    bool
+	AddrTimeout time.Duration
+
+	// Sink, if set, is given the result of every successful query.
+	Sink Sink
+
+	// MinPrecision, if non-zero, is the coarsest server precision
+	// accepted.  Replies advertising a coarser precision fail with
+	// ErrPrecisionTooCoarse; two to the power of -10, 0.977ms, is for
+	// example accepted for a MinPrecision of 1ms but two to the -9 is
+	// not.
+	MinPrecision time.Duration
+
+	// ExpectedRefID, if set, is the reference identifier stratum 1
+	// replies must carry, such as "GPS" or "PPS".  A stratum 1 reply
+	// with any other identifier fails with an error wrapping
+	// ErrUnexpectedRefID.
+	ExpectedRefID string
+
+	// AllowedRefIDs, if not empty, lists the reference identifiers
+	// stratum 1 replies may carry, such as "GPS", "PPS" and "DCF".  A
+	// stratum 1 reply with any other identifier fails with an error
+	// wrapping ErrUnexpectedRefID.
+	AllowedRefIDs []string
+
+	// Auth, if set, makes the query use symmetric key authentication: a
+	// MAC computed with the key is appended to the request, and replies
+	// without a valid MAC are rejected with ErrAuthFailed.
+	Auth *SymmetricKey
+
+	// Version is the NTP version of the request.  If zero, 4 is used.
+	Version byte
+
+	// RawLiVnMode makes LiVnMode be sent verbatim as the first byte of
+	// the request, holding the leap indicator, version and mode, instead
+	// of a version Version client request.  It is meant for testing how
+	// servers handle malformed requests; replies are checked as usual.
+	RawLiVnMode bool
+	LiVnMode    byte
+
+	// Downgrade makes a version 4 query that gets no reply, or with
+	// Strict a reply of another version (ErrVersionMismatch), try again
+	// with version 3, for legacy servers ignoring newer requests.
+	// Without Strict a reply of another version is accepted as it is,
+	// with NtpStats.VersionMismatch set.
+	Downgrade bool
+
+	// Strict enables every RFC 5905 client-side sanity check on replies,
+	// failing the query with a specific error if: the reply is not in
+	// server mode (ErrInvalidMode), its stratum is above 16
+	// (ErrInvalidStratum), its leap indicator is alarm
+	// (ErrServerNotSynchronized, unless AlarmCheck is AlarmCheckOff),
+	// its root distance exceeds 1.5 seconds (ErrRootDistance), its
+	// transmit time precedes its receive time (ErrTransmitBeforeReceive)
+	// or its reference time (ErrTransmitBeforeRef), or its version is
+	// not that of the request (ErrVersionMismatch).  The origin and zero
+	// timestamp checks, and those of stratum 0 and 16, are made in all
+	// modes.
+	Strict bool
+
+	// SpoofCheck hardens the query against forged replies that pass the
+	// origin check by echoing the request's transmit time but otherwise
+	// carry made-up timestamps.  Replies fail with ErrSpoofedReply if
+	// their receive or transmit time equals the origin time, if the two
+	// are out of order or, unless SingleStamp is set, equal, or if the
+	// transmit time is further than SpoofWindow from the local time the
+	// reply arrived, 24 hours if zero.  Servers with clocks too coarse
+	// to tell receive and transmit apart fail it too.
+	SpoofCheck  bool
+	SpoofWindow time.Duration
+
+	// SingleStamp accepts servers that stamp their replies once: a zero
+	// receive time is replaced by the transmit time, and SpoofCheck lets
+	// the two be equal.
+	SingleStamp bool
+
+	// AlarmCheck selects whether a server whose leap indicator is
+	// alarm, meaning its clock is not synchronized, is rejected with
+	// ErrServerNotSynchronized.  By default this is part of Strict mode.
+	AlarmCheck AlarmCheck
+
+	// DontFragment sets the don't fragment bit on requests, so that an
+	// authenticated or extended packet too large for the path fails with
+	// an error matching ErrPacketTooLarge rather than being silently
+	// lost as fragments.  Only Linux supports it; elsewhere the query
+	// fails in the dial phase.  The error is only reported once the
+	// kernel has learnt the path MTU, usually from a previous attempt.
+	DontFragment bool
+
+	// MaxReplyLen is the size of the buffer replies are read into, in
+	// bytes.  Longer replies are truncated: their header is used and the
+	// rest ignored, setting NtpStats.Truncated, except with Auth, whose
+	// MAC would be lost, where they fail the query.  If zero, 72 is
+	// used, enough for a header with a SHA1 MAC.  Raise it to read the
+	// extension fields of NTS or similar replies.  Values below 48 are
+	// invalid.
+	MaxReplyLen int
+
+	// MaxTime is the latest server receive or transmit time accepted;
+	// replies with later timestamps fail with ErrFutureTimestamp.  If
+	// zero, the start of 2100 is used.
+	MaxTime time.Time
+
+	// BestEffort makes the checks that do not show the reply to be
+	// forged or meaningless report their failures in NtpStats.Warnings
+	// rather than fail the query.  These are the reference ID and
+	// precision checks and, in Strict mode, the root distance, transmit
+	// time and version checks.  All other failures remain errors.
+	BestEffort bool
+
+	// LeapTable, if set, makes the query report the offset of TAI from
+	// the local clock in NtpStats.TAIOffset, taking TAI-UTC at the
+	// server's transmit time from the table.  Queries fail with
+	// ErrLeapTableRange if the table does not cover that time.
+	LeapTable LeapTable
+
+	// Reference, if set, reads a local reference clock taken to keep
+	// true time, such as one disciplined by a GPS PPS signal.  It is read
+	// right before the request is sent and right after the reply is
+	// received, and the server's error against it is reported in
+	// NtpStats.ServerError.  The result is no better than the reference:
+	// any difference between it and UTC, and any latency or jitter in
+	// calling it, enter the error directly, while the network delay
+	// asymmetry limits it as it does the offset.
+	Reference func() time.Time
+
+	// ReadBuffer and WriteBuffer, if non-zero, set the size of the
+	// socket's operating system receive and transmit buffers.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// ReusePort lets ReceiveBroadcast bind its port while other sockets
+	// are bound to it, as when several processes listen for broadcasts
+	// or one restarts.  It sets SO_REUSEADDR and SO_REUSEPORT on Linux
+	// and the BSDs, where every socket bound to the port must set it,
+	// and SO_REUSEADDR on Windows.  Other platforms fail to listen.
+	ReusePort bool
+
+	// lastTransmit is the transmit timestamp of the previous reply from
+	// the same server, if known, for detecting duplicates.
+	lastTransmit Timestamp
+}
+
+// A Sink receives measured offsets, for instance to discipline a clock
+// or record metrics.
+type Sink interface {
+	Apply(offset time.Duration, stats NtpStats)
+}
+
+// NopSink is a Sink that discards everything.
+var NopSink Sink = nopSink{}
+
+type nopSink struct{}
+
+func (nopSink) Apply(time.Duration, NtpStats) {}
+
+const defaultConcurrency = 16
+
+func (opt QueryOptions) concurrency() int {
+	if opt.Concurrency > 0 {
+		return opt.Concurrency
+	}
+	return defaultConcurrency
+}
+
+func (opt QueryOptions) version() byte {
+	if opt.Version != 0 {
+		return opt.Version
+	}
+	return 4
+}
+
+func (opt QueryOptions) maxReplyLen() int {
+	if opt.MaxReplyLen != 0 {
+		return opt.MaxReplyLen
+	}
+	return headerLen + 4 + sha1.Size
+}
+
+func (opt QueryOptions) maxTime() time.Time {
+	if !opt.MaxTime.IsZero() {
+		return opt.MaxTime
+	}
+	return time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (opt QueryOptions) port() int {
+	if opt.Port != 0 {
+		return opt.Port
+	}
+	if opt.LookupPort {
+		if p, err := lookupPort("udp", "ntp"); err == nil {
+			return p
+		}
+	}
+	return 123
+}
+
+func (opt QueryOptions) resolveTimeout() time.Duration {
+	if opt.ResolveTimeout > 0 {
+		return opt.ResolveTimeout
+	}
+	return opt.timeout()
+}
+
+func (opt QueryOptions) spoofWindow() time.Duration {
+	if opt.SpoofWindow > 0 {
+		return opt.SpoofWindow
+	}
+	return 24 * time.Hour
+}
+
+func (opt QueryOptions) timeout() time.Duration {
+	if opt.Timeout > 0 {
+		return opt.Timeout
+	}
+	return 5 * time.Second
+}
+
 // Request returns NTP stats: rtt delay and offset
 // from the remote NTP server
 // specifed as host.  NTP client mode is used.
 func Request(host string) (NtpStats, error) {
-	saneEpoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
-	stats := NtpStats{}
-	raddr, err := net.ResolveUDPAddr("udp", host+":123")
+	return QueryWithOptions(host, QueryOptions{})
+}
+
+// RequestContext is like Request but gives up, returning ctx.Err(), as
+// soon as ctx is done.
+func RequestContext(ctx context.Context, host string) (NtpStats, error) {
+	return QueryContext(ctx, host, QueryOptions{})
+}
+
+// QueryWithOptions performs the same query as Request using the
+// parameters in opt.
+func QueryWithOptions(host string, opt QueryOptions) (NtpStats, error) {
+	return QueryContext(context.Background(), host, opt)
+}
+
+// QueryContext is like QueryWithOptions but gives up, returning
+// ctx.Err(), as soon as ctx is done.
+func QueryContext(ctx context.Context, host string, opt QueryOptions) (NtpStats, error) {
+	if opt.MaxReplyLen != 0 && opt.MaxReplyLen < headerLen {
+		return NtpStats{}, errors.New("MaxReplyLen below 48")
+	}
+	if opt.ReadBuffer < 0 || opt.WriteBuffer < 0 {
+		return NtpStats{}, errors.New("negative socket buffer size")
+	}
+
+	var budget time.Time
+	if opt.TotalBudget > 0 {
+		budget = time.Now().Add(opt.TotalBudget)
+	}
+
+	var stats NtpStats
+	var err error
+	for try := 0; try <= opt.Retries; try++ {
+		if err := ctx.Err(); err != nil {
+			return NtpStats{}, err
+		}
+		if try > 0 && !budget.IsZero() && !time.Now().Before(budget) {
+			break
+		}
+		stats, err = attempt(ctx, host, opt, budget)
+		if err != nil && opt.Downgrade && opt.version() == 4 && (isTimeout(err) || errors.Is(err, ErrVersionMismatch)) && ctx.Err() == nil {
+			v3 := opt
+			v3.Version = 3
+			stats, err = attempt(ctx, host, v3, budget)
+			stats.Downgraded = err == nil
+		}
+		var kod *KissOfDeathError
+		if err == nil || errors.As(err, &kod) {
+			break
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		return NtpStats{}, ctx.Err()
+	}
+	if err == nil && opt.Sink != nil {
+		opt.Sink.Apply(stats.Offset, stats)
+	}
+	return stats, err
+}
+
+// sleepContext waits for d to elapse, returning ctx.Err() early if ctx is
+// done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// attempt resolves host and queries its addresses in turn, finishing by
+// budget if it is non-zero, or when ctx is done.
+func attempt(ctx context.Context, host string, opt QueryOptions, budget time.Time) (NtpStats, error) {
+	rdeadline := time.Now().Add(opt.resolveTimeout())
+	if !budget.IsZero() && budget.Before(rdeadline) {
+		rdeadline = budget
+	}
+	rctx, cancel := context.WithDeadline(ctx, rdeadline)
+	addrs, err := resolve(rctx, host, opt)
+	cancel()
+	if err != nil {
+		return NtpStats{}, &TransportError{"resolve", err}
+	}
+
+	deadline := time.Now().Add(opt.timeout())
+	if !budget.IsZero() && budget.Before(deadline) {
+		deadline = budget
+	}
+
+	var stats NtpStats
+	for i, raddr := range addrs {
+		d := deadline
+		if len(addrs) > 1 {
+			per := opt.AddrTimeout
+			if per <= 0 {
+				per = time.Until(deadline) / time.Duration(len(addrs)-i)
+			}
+			if t := time.Now().Add(per); t.Before(d) {
+				d = t
+			}
+		}
+
+		stats, err = query(ctx, raddr, opt, d)
+		if err == nil {
+			stats.FallbackAddr = i > 0
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return stats, err
+}
+
+// query performs a single exchange with the server at raddr, which must
+// complete by deadline and is cut short if ctx is done first.
+func query(ctx context.Context, raddr *net.UDPAddr, opt QueryOptions, deadline time.Time) (NtpStats, error) {
+	con, err := dial(ctx, raddr, opt, deadline)
+	if err != nil {
+		return NtpStats{}, err
+	}
+	defer con.Close()
+	con.SetDeadline(deadline)
+	defer watchContext(ctx, con)()
+
+	stats, err := exchange(con, func(buf []byte, _ ntpTime) (int, error) {
+		return con.Read(buf)
+	}, opt)
 	if err != nil {
 		return stats, err
 	}
+	stats.LocalAddr = con.LocalAddr()
+	stats.RemoteAddr = con.RemoteAddr()
+	return stats, nil
+}
+
+// dial connects a UDP socket to raddr, set up as opt requires, waiting
+// until deadline for the socket limit to allow it.
+func dial(ctx context.Context, raddr *net.UDPAddr, opt QueryOptions, deadline time.Time) (*limitedConn, error) {
+	release, err := acquireSocket(ctx, deadline)
+	if err != nil {
+		return nil, &TransportError{"dial", err}
+	}
+	con, err := net.DialUDP("udp", opt.LocalAddr, raddr)
+	if err != nil {
+		release()
+		return nil, &TransportError{"dial", err}
+	}
+	err = nil
+	if opt.DontFragment {
+		err = setDontFragment(con)
+	}
+	if err == nil {
+		err = setBuffers(con, opt)
+	}
+	if err != nil {
+		con.Close()
+		release()
+		return nil, &TransportError{"dial", err}
+	}
+	return &limitedConn{con, release}, nil
+}
+
+// setBuffers sets the socket buffer sizes given by opt.ReadBuffer and
+// opt.WriteBuffer on c, leaving those that are zero alone.
+func setBuffers(c interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}, opt QueryOptions) error {
+	if opt.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(opt.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opt.WriteBuffer > 0 {
+		return c.SetWriteBuffer(opt.WriteBuffer)
+	}
+	return nil
+}
+
+// A limitedConn is a socket counted against the limit of SetMaxSockets,
+// released when it is closed.
+type limitedConn struct {
+	*net.UDPConn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.UDPConn.Close()
+	c.release()
+	return err
+}
+
+// watchContext makes the pending and later reads and writes on con fail
+// once ctx is done, until the returned function is called.  Once that
+// returns the deadline of con is no longer touched.
+func watchContext(ctx context.Context, con interface{ SetDeadline(time.Time) error }) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			con.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// QueryPacketConn queries the server at raddr over con, which need not be
+// connected, so that one socket can serve many servers.  Datagrams that
+// do not come from raddr or do not answer the request are discarded, so
+// queries sharing con must not run concurrently, and an attempt timing
+// out after discarding datagrams from other addresses fails with
+// ErrWrongSource.  Each attempt's deadline is set from opt.Timeout,
+// failed attempts are retried as opt.Retries allows and opt.Sink is given
+// a successful result, but the addressing options of opt, TotalBudget,
+// Downgrade and those setting up the socket are ignored.
+func QueryPacketConn(con net.PacketConn, raddr *net.UDPAddr, opt QueryOptions) (NtpStats, error) {
+	return QueryPacketConnContext(context.Background(), con, raddr, opt)
+}
+
+// QueryPacketConnContext is like QueryPacketConn but gives up, returning
+// ctx.Err(), when ctx is done.
+func QueryPacketConnContext(ctx context.Context, con net.PacketConn, raddr *net.UDPAddr, opt QueryOptions) (NtpStats, error) {
+	var stats NtpStats
+	var err error
+	for try := 0; try <= opt.Retries; try++ {
+		if err := ctx.Err(); err != nil {
+			return NtpStats{}, err
+		}
+		stats, err = queryPacketConn(ctx, con, raddr, opt)
+		var kod *KissOfDeathError
+		if err == nil || errors.As(err, &kod) {
+			break
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		return NtpStats{}, ctx.Err()
+	}
+	if err == nil && opt.Sink != nil {
+		opt.Sink.Apply(stats.Offset, stats)
+	}
+	return stats, err
+}
 
-	con, err := net.DialUDP("udp", nil, raddr)
+// queryPacketConn makes one attempt of QueryPacketConn.
+func queryPacketConn(ctx context.Context, con net.PacketConn, raddr *net.UDPAddr, opt QueryOptions) (NtpStats, error) {
+	con.SetDeadline(time.Now().Add(opt.timeout()))
+	defer con.SetDeadline(time.Time{})
+	defer watchContext(ctx, con)()
+
+	wrongSource := false
+	stats, err := exchange(packetWriter{con, raddr}, func(buf []byte, xmit ntpTime) (int, error) {
+		for {
+			n, addr, err := con.ReadFrom(buf)
+			if err != nil {
+				if wrongSource && ctx.Err() == nil {
+					return n, ErrWrongSource
+				}
+				return n, err
+			}
+			from, ok := addr.(*net.UDPAddr)
+			if !ok || !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+				wrongSource = true
+				continue
+			}
+			if n >= headerLen && binary.BigEndian.Uint32(buf[24:]) == xmit.Seconds &&
+				binary.BigEndian.Uint32(buf[28:]) == xmit.Fraction {
+				return n, nil
+			}
+		}
+	}, opt)
+	if errors.Is(err, ErrWrongSource) {
+		return NtpStats{}, ErrWrongSource
+	}
 	if err != nil {
 		return stats, err
 	}
-	defer con.Close()
-	con.SetDeadline(time.Now().Add(5 * time.Second))
+	stats.LocalAddr = con.LocalAddr()
+	stats.RemoteAddr = raddr
+	return stats, nil
+}
+
+// A packetWriter writes to an unconnected PacketConn as if it were
+// connected to addr.
+type packetWriter struct {
+	con  net.PacketConn
+	addr net.Addr
+}
+
+func (w packetWriter) Write(b []byte) (int, error) {
+	return w.con.WriteTo(b, w.addr)
+}
+
+// exchange sends a request built from opt to w and reads the reply with
+// read, which is given the request's transmit time, then checks the reply
+// and computes its stats.
+func exchange(w io.Writer, read func(buf []byte, xmit ntpTime) (int, error), opt QueryOptions) (NtpStats, error) {
+	r := &request{opt: opt}
+	if err := r.send(w); err != nil {
+		return NtpStats{}, &TransportError{"write", err}
+	}
 
+	// One spare byte tells replies that were truncated.
+	buf := make([]byte, opt.maxReplyLen()+1)
+	n, err := read(buf, r.xmit)
+	if err != nil {
+		return NtpStats{}, &TransportError{"read", err}
+	}
+	return r.reply(buf[:n], now())
+}
+
+// A request is a client request sent to a server, kept for checking the
+// reply to it.
+type request struct {
+	opt       QueryOptions
+	version   byte    // version bits as sent
+	xmit      ntpTime // transmit time as sent
+	origin    time.Time
+	refOrigin time.Time
+	packet    []byte
+}
+
+// send builds the request from r.opt and writes it to w.  A non-zero
+// r.xmit is used as the transmit time.
+func (r *request) send(w io.Writer) error {
+	opt := r.opt
 	m := new(msg)
-	m.SetMode(client)
-	m.SetVersion(4)
-	originTime := time.Now() // time client sent request
-	m.SetTransmitTime(toNtpTime(originTime))
+	m.SetMode(ModeClient)
+	m.SetVersion(opt.version())
+	if opt.RawLiVnMode {
+		m.LiVnMode = opt.LiVnMode
+	}
+	r.version = (m.LiVnMode >> 3) & 0x07
+	m.Poll = byte(opt.Poll)
+	m.Precision = byte(opt.Precision)
+	if opt.Reference != nil {
+		r.refOrigin = opt.Reference()
+	}
+	r.origin = now() // time client sent request
+	if r.xmit == (ntpTime{}) {
+		r.xmit = toNtpTime(r.origin)
+		if !opt.TransmitTime.IsZero() {
+			r.xmit = toNtpTime(opt.TransmitTime)
+		}
+	}
+	m.SetTransmitTime(r.xmit)
+
+	var err error
+	r.packet, err = writeMsg(w, m, opt.Auth)
+	return err
+}
 
-	err = binary.Write(con, binary.BigEndian, m)
+// reply checks the reply b to the request, received at destinationTime,
+// and computes its stats.
+func (r *request) reply(b []byte, destinationTime time.Time) (NtpStats, error) {
+	opt := r.opt
+	var refDestination time.Time
+	if opt.Reference != nil {
+		refDestination = opt.Reference()
+	}
+	// Only the header of a truncated reply is parsed.
+	body, truncated := b, len(b) > opt.maxReplyLen()
+	if truncated {
+		if opt.Auth != nil {
+			return NtpStats{}, errors.New("authenticated reply longer than MaxReplyLen")
+		}
+		b, body = b[:opt.maxReplyLen()], b[:headerLen]
+	}
+	m, err := parsePacket(body)
+	if err != nil {
+		return NtpStats{}, err
+	}
+	if opt.Auth != nil {
+		if err := opt.Auth.verify(b); err != nil {
+			return NtpStats{}, err
+		}
+	}
+
+	sm := m
+	if opt.SingleStamp && m.ReceiveTime == (ntpTime{}) {
+		c := *m
+		c.ReceiveTime = c.TransmitTime
+		sm = &c
+	}
+	stats, err := computeStats(sm, r.origin, destinationTime)
 	if err != nil {
 		return stats, err
 	}
+	stats.RawReceiveTime = m.ReceiveTime.raw()
+	if limit := opt.maxTime(); stats.ReceiveTime.After(limit) || stats.TransmitTime.After(limit) {
+		return NtpStats{}, ErrFutureTimestamp
+	}
 
-	err = binary.Read(con, binary.BigEndian, m)
+	// check that the reply is new and answers our request
+	if opt.lastTransmit != 0 && m.TransmitTime.raw() == opt.lastTransmit {
+		return NtpStats{}, ErrDuplicatePacket
+	}
+	if m.OriginTime != r.xmit {
+		return NtpStats{}, ErrBogusPacket
+	}
+	if opt.SpoofCheck {
+		if err := checkSpoof(m, stats, opt.spoofWindow(), opt.SingleStamp); err != nil {
+			return NtpStats{}, err
+		}
+	}
+
+	switch m.Stratum {
+	case 0:
+		return NtpStats{}, &KissOfDeathError{refIDString(m.ReferenceId)}
+	case 16:
+		return NtpStats{}, ErrUnsynchronizedServer
+	}
+
+	if m.LiVnMode>>6 == leapAlarm && opt.AlarmCheck.enabled(opt.Strict) {
+		return NtpStats{}, ErrServerNotSynchronized
+	}
+
+	var problems []error
+	if id := refIDString(m.ReferenceId); m.Stratum == 1 && opt.ExpectedRefID != "" && id != opt.ExpectedRefID {
+		problems = append(problems, fmt.Errorf("%w %q", ErrUnexpectedRefID, id))
+	} else if m.Stratum == 1 && len(opt.AllowedRefIDs) > 0 && !containsString(opt.AllowedRefIDs, id) {
+		problems = append(problems, fmt.Errorf("%w %q", ErrUnexpectedRefID, id))
+	}
+	if stats.Version != r.version {
+		stats.VersionMismatch = true
+		if opt.Strict {
+			problems = append(problems, ErrVersionMismatch)
+		}
+	}
+	if opt.MinPrecision > 0 && stats.Precision > opt.MinPrecision {
+		problems = append(problems, ErrPrecisionTooCoarse)
+	}
+	if opt.Strict {
+		problems = append(problems, validateStrict(m, stats)...)
+	}
+	for _, p := range problems {
+		if !opt.BestEffort || !isWarning(p) {
+			return NtpStats{}, p
+		}
+		stats.Warnings = append(stats.Warnings, p)
+	}
+
+	if opt.LeapTable != nil {
+		d, err := opt.LeapTable.At(stats.TransmitTime)
+		if err != nil {
+			return NtpStats{}, err
+		}
+		stats.TAIOffset = stats.Offset + d
+	}
+	if opt.Reference != nil {
+		stats.ServerError = (stats.ReceiveTime.Sub(r.refOrigin) + stats.TransmitTime.Sub(refDestination)) / 2
+	}
+	stats.ReplyLen = len(b)
+	stats.ReplyChecksum = crc32.ChecksumIEEE(b)
+	stats.Class = ClassifyPacket(b)
+	if truncated {
+		stats.Class, stats.Truncated = PacketExtended, true
+	}
+	stats.RequestPacket = r.packet
+	if stats.CoarseClock {
+		stats.ClockResolution = localClockResolution()
+	}
+	return stats, nil
+}
+
+// resolve returns the addresses of the NTP service on host to try in
+// turn: all of them with opt.Fallback, otherwise only one, preferring
+// IPv4 unless opt.RandomAddr is set.
+func resolve(ctx context.Context, host string, opt QueryOptions) ([]*net.UDPAddr, error) {
+	port := opt.port()
+
+	ips, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if opt.RandomAddr {
+		rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	} else {
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ips[i].IP.To4() != nil && ips[j].IP.To4() == nil
+		})
+	}
+	if !opt.Fallback {
+		ips = ips[:1]
+	}
+
+	addrs := make([]*net.UDPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+	}
+	return addrs, nil
+}
+
+// StatsFromPacket computes NTP stats from a captured server reply
+// and the time it was received, without reading the local clock.  The
+// origin time is taken from the packet itself, so unlike Request the reply
+// is not checked against a request.
+func StatsFromPacket(b []byte, destinationTime time.Time) (NtpStats, error) {
+	m, err := parsePacket(b)
+	if err != nil {
+		return NtpStats{}, err
+	}
+	stats, err := computeStats(m, m.OriginTime.UTC(), destinationTime)
 	if err != nil {
 		return stats, err
 	}
+	stats.ReplyLen = len(b)
+	stats.ReplyChecksum = crc32.ChecksumIEEE(b)
+	stats.Class = ClassifyPacket(b)
+	return stats, nil
+}
 
-	destinationTime := time.Now() // time client got reply
+// Interleaved returns the stats of the exchange prev recomputed with the
+// transmit time reported in cur, the reply to the following request.  In
+// interleaved mode a server sends the transmit timestamp it captured for
+// its previous reply, typically taken by the kernel or hardware after the
+// packet left and hence more accurate than the estimate a server can put
+// in the packet it is sending, so the pairing is T1, T2 and T4 from prev
+// with T3 from cur.  Driving the exchange in interleaved mode, and telling
+// such replies apart, is left to the caller.
+func Interleaved(prev, cur NtpStats) NtpStats {
+	s := prev
+	s.TransmitTime = cur.TransmitTime
+	s.ServerProcessingDelay = s.TransmitTime.Sub(s.ReceiveTime)
+	s.Delay = s.DestinationTime.Sub(s.OriginTime) - s.ServerProcessingDelay
+	s.Offset = (s.ReceiveTime.Sub(s.OriginTime) + s.TransmitTime.Sub(s.DestinationTime)) / 2
+	return s
+}
+
+// computeStats returns the stats of the exchange in which the request was
+// sent at originTime and the reply m received at destinationTime.
+func computeStats(m *msg, originTime, destinationTime time.Time) (NtpStats, error) {
+	saneEpoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	receiveTime := m.ReceiveTime.UTC()   // time server got request
 	transmitTime := m.TransmitTime.UTC() // time server scheduled reply
 
 	if receiveTime.Before(saneEpoch) || transmitTime.Before(saneEpoch) {
-		return stats, errors.New("received zero packet")
-	}
-
-	// check that server replies to our request
-	if m.OriginTime != toNtpTime(originTime) {
-		return stats, errors.New("received bogus packet")
+		return NtpStats{}, errors.New("received zero packet")
 	}
 
 	netRttDelay := destinationTime.Sub(originTime)
@@ -140,7 +1452,91 @@ func Request(host string) (NtpStats, error) {
 
 	offset := (receiveTime.Sub(originTime) + transmitTime.Sub(destinationTime)) / 2
 
-	stats = NtpStats{delay, offset}
+	// The offset comes from the wall clock, so its resolution is what
+	// matters, not that of the monotonic clock netRttDelay may use.
+	coarse := destinationTime.Round(0).Equal(originTime.Round(0))
+	if netRttDelay == 0 {
+		delay = 0
+	}
+
+	stats := NtpStats{
+		Delay:                 delay,
+		Offset:                offset,
+		ServerProcessingDelay: srvSchedDelay,
+		CoarseClock:           coarse,
+		SingleStamp:           m.ReceiveTime == m.TransmitTime,
+		TransmitBeforeRef:     transmitTime.Before(m.ReferenceTime.UTC()),
+
+		Leap:           m.LiVnMode >> 6,
+		Mode:           Mode(m.LiVnMode & 0x07),
+		Version:        (m.LiVnMode >> 3) & 0x07,
+		Stratum:        m.Stratum,
+		ReferenceID:    m.ReferenceId,
+		Poll:           log2ToDuration(int8(m.Poll)),
+		Precision:      log2ToDuration(int8(m.Precision)),
+		RootDelay:      ShortToDuration(m.RootDelay),
+		RootDispersion: ShortToDuration(m.RootDispersion),
+
+		ReferenceTime:   m.ReferenceTime.UTC(),
+		OriginTime:      originTime,
+		ReceiveTime:     receiveTime,
+		TransmitTime:    transmitTime,
+		DestinationTime: destinationTime,
+
+		RawReferenceTime: m.ReferenceTime.raw(),
+		RawOriginTime:    m.OriginTime.raw(),
+		RawReceiveTime:   m.ReceiveTime.raw(),
+		RawTransmitTime:  m.TransmitTime.raw(),
+	}
 	return stats, nil
+}
+
+// now reads the local clock for the origin and destination times of
+// queries.  Tests replace it to simulate other clocks.
+var now = time.Now
 
+// lookupIPAddr resolves the host names of queries.  Tests replace it to
+// simulate names with several addresses.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// lookupPort looks up service ports for LookupPort.  Tests replace it to
+// simulate services databases.
+var lookupPort = net.LookupPort
+
+var (
+	clockResolutionOnce sync.Once
+	clockResolution     time.Duration
+)
+
+// localClockResolution estimates the resolution of the wall clock as the
+// interval between two successive changes of time.Now, taking at most
+// about a second.  It spins for the first few milliseconds, enough for
+// most clocks, then polls with short sleeps so that very coarse clocks
+// do not cost a second of CPU.  The result is computed once.
+func localClockResolution() time.Duration {
+	clockResolutionOnce.Do(func() {
+		start := time.Now()
+		limit := start.Add(time.Second)
+		next := func(t time.Time) time.Time {
+			for {
+				n := time.Now().Round(0)
+				if !n.Equal(t) || n.After(limit) {
+					return n
+				}
+				if time.Since(start) > resolutionSpin {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}
+		t0 := next(time.Now().Round(0))
+		clockResolution = next(t0).Sub(t0)
+		if clockResolution <= 0 || !time.Now().Before(limit) {
+			clockResolution = time.Second
+		}
+	})
+	return clockResolution
 }
+
+// resolutionSpin is how long localClockResolution spins before it
+// starts sleeping between readings.
+const resolutionSpin = 10 * time.Millisecond
@@ -0,0 +1,1381 @@
+package ntp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+// t0 is an arbitrary instant the synthetic exchanges in tests start at.
+var t0 = time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+
+// encodeMsg returns the wire form of m.
+func encodeMsg(m *msg) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, m)
+	return b.Bytes()
+}
+
+// serverMsg returns a version 4 stratum 2 server reply to a request sent
+// at t1, received by the server at t2 and answered at t3.
+func serverMsg(t1, t2, t3 time.Time) *msg {
+	m := &msg{
+		Stratum:       2,
+		ReferenceTime: toNtpTime(t1.Add(-time.Minute)),
+		OriginTime:    toNtpTime(t1),
+		ReceiveTime:   toNtpTime(t2),
+		TransmitTime:  toNtpTime(t3),
+	}
+	m.SetVersion(4)
+	m.SetMode(ModeServer)
+	return m
+}
+
+// newServer starts an ntptest server answering with r, closed when the
+// test ends.
+func newServer(t *testing.T, r ntptest.Reply) *ntptest.Server {
+	t.Helper()
+	s, err := ntptest.NewServer(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newPool starts a server for each of replies on one port, at 127.0.0.1,
+// 127.0.0.2 and so on, and returns their hosts and the port.  The test is
+// skipped where the loopback network cannot be bound beyond 127.0.0.1.
+func newPool(t *testing.T, replies ...ntptest.Reply) ([]string, int) {
+	t.Helper()
+	var hosts []string
+	port := 0
+	for i, r := range replies {
+		s, err := ntptest.NewServerAt(net.JoinHostPort(net.IPv4(127, 0, 0, byte(i+1)).String(), strconv.Itoa(port)), r)
+		if err != nil {
+			t.Skipf("cannot listen on the loopback network: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		hosts, port = append(hosts, s.Host), s.Port
+	}
+	return hosts, port
+}
+
+// FuzzParsePacket checks that parsePacket neither panics nor accepts a
+// packet it cannot account for.  The seed corpus in testdata/fuzz holds
+// well-formed replies, authenticated and extended ones, and malformed
+// variants of them.
+func FuzzParsePacket(f *testing.F) {
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := parsePacket(b)
+		ClassifyPacket(b)
+		if err != nil {
+			if m != nil {
+				t.Fatalf("parsePacket(%x) returned a message and error %v", b, err)
+			}
+			return
+		}
+		if len(b) < headerLen || (len(b)-headerLen)%4 != 0 {
+			t.Fatalf("parsePacket accepted a %d byte packet", len(b))
+		}
+		if v := (m.LiVnMode >> 3) & 0x07; v < 1 || v > 4 {
+			t.Fatalf("parsePacket accepted version %d", v)
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, m)
+		if !bytes.Equal(buf.Bytes(), b[:headerLen]) {
+			t.Fatalf("header %x re-encodes as %x", b[:headerLen], buf.Bytes())
+		}
+		StatsFromPacket(b, m.TransmitTime.UTC())
+	})
+}
+
+func TestOneWayDelay(t *testing.T) {
+	// 32ms round trip, of which the server held the request for 2ms.
+	b := encodeMsg(serverMsg(t0, t0.Add(10*time.Millisecond), t0.Add(12*time.Millisecond)))
+	stats, err := StatsFromPacket(b, t0.Add(32*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Delay != 30*time.Millisecond {
+		t.Fatalf("Delay = %v, want 30ms", stats.Delay)
+	}
+	if d := stats.OneWayDelay(); d != 15*time.Millisecond {
+		t.Errorf("OneWayDelay() = %v, want 15ms", d)
+	}
+}
+
+func TestFixedTransmitTime(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	opt := QueryOptions{Port: s.Port, TransmitTime: t0}
+
+	var packets [][]byte
+	for i := 0; i < 2; i++ {
+		stats, err := QueryWithOptions(s.Host, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, stats.RequestPacket)
+	}
+	if !bytes.Equal(packets[0], packets[1]) {
+		t.Errorf("requests differ:\n%x\n%x", packets[0], packets[1])
+	}
+	if xmit := TimeToNTP(t0); !bytes.Equal(packets[0][40:48], xmit[:]) {
+		t.Errorf("transmit time %x, want %x", packets[0][40:48], xmit)
+	}
+}
+
+// shortWriter accepts only the first n bytes of each write.
+type shortWriter struct{ n int }
+
+func (w shortWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		return w.n, nil
+	}
+	return len(b), nil
+}
+
+// failingWriter fails every write with err.
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestShortWrite(t *testing.T) {
+	read := func(buf []byte, _ ntpTime) (int, error) {
+		t.Fatal("reply read after a failed write")
+		return 0, nil
+	}
+
+	_, err := exchange(shortWriter{47}, read, QueryOptions{})
+	var te *TransportError
+	if !errors.As(err, &te) || te.Phase != "write" || !errors.Is(err, ErrShortWrite) {
+		t.Errorf("short write: err = %v, want a write error wrapping ErrShortWrite", err)
+	}
+
+	broken := errors.New("broken pipe")
+	_, err = exchange(failingWriter{broken}, read, QueryOptions{})
+	if !errors.As(err, &te) || te.Phase != "write" || !errors.Is(err, broken) || errors.Is(err, ErrShortWrite) {
+		t.Errorf("failed write: err = %v, want a write error wrapping the writer's", err)
+	}
+}
+
+func TestAsymmetry(t *testing.T) {
+	// The clocks agree, but the request takes 30ms and the reply 10ms.
+	b := encodeMsg(serverMsg(t0, t0.Add(30*ms), t0.Add(31*ms)))
+	stats, err := StatsFromPacket(b, t0.Add(41*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The asymmetry shows up as half its size in the offset.
+	if stats.Offset != 10*ms {
+		t.Fatalf("Offset = %v, want 10ms", stats.Offset)
+	}
+	if a := stats.Asymmetry(0); a != 20*ms {
+		t.Errorf("Asymmetry(0) = %v, want 20ms", a)
+	}
+	if a := stats.Asymmetry(stats.Offset); a != 0 {
+		t.Errorf("Asymmetry(Offset) = %v, want 0", a)
+	}
+	// An error in the true offset appears doubled.
+	if a := stats.Asymmetry(ms); a != 18*ms {
+		t.Errorf("Asymmetry(1ms) = %v, want 18ms", a)
+	}
+}
+
+func TestRequestPollPrecision(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	tests := []struct {
+		poll, precision int8
+		want            [2]byte
+	}{
+		{0, 0, [2]byte{0, 0}},
+		{6, -20, [2]byte{6, 0xec}},
+		{17, -6, [2]byte{17, 0xfa}},
+	}
+	for _, tt := range tests {
+		stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, Poll: tt.poll, Precision: tt.precision})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := [2]byte{stats.RequestPacket[2], stats.RequestPacket[3]}; got != tt.want {
+			t.Errorf("poll %d, precision %d: sent %x, want %x", tt.poll, tt.precision, got, tt.want)
+		}
+	}
+}
+
+// gpsReply is a stratum 1 GPS reply to a request sent at gpsSent.  The
+// server received it 250ms later by its clock and answered 62.5ms after
+// that.
+var gpsReply, _ = hex.DecodeString("240106e9000000100000002047505300" +
+	"eca6f3a000000000eca6f3b000000000eca6f3b040000000eca6f3b050000000")
+
+var gpsSent = time.Date(2025, 10, 25, 6, 58, 56, 0, time.UTC)
+
+func TestStatsFromPacket(t *testing.T) {
+	// The reply arrived 125ms after the request left.
+	b := gpsReply
+	sent := gpsSent
+	stats, err := StatsFromPacket(b, sent.Add(125*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stats.OriginTime.Equal(sent) {
+		t.Errorf("OriginTime = %v, want %v", stats.OriginTime, sent)
+	}
+	if stats.Delay != 62500*time.Microsecond {
+		t.Errorf("Delay = %v, want 62.5ms", stats.Delay)
+	}
+	if stats.Offset != 218750*time.Microsecond {
+		t.Errorf("Offset = %v, want 218.75ms", stats.Offset)
+	}
+	if stats.Stratum != 1 || refIDString(stats.ReferenceID) != "GPS" || stats.Version != 4 || stats.Mode != ModeServer {
+		t.Errorf("header decoded as stratum %d, refid %q, version %d, mode %v",
+			stats.Stratum, refIDString(stats.ReferenceID), stats.Version, stats.Mode)
+	}
+
+	if _, err := StatsFromPacket(b[:40], sent); err == nil {
+		t.Error("no error for a short packet")
+	}
+	zero := append([]byte(nil), b...)
+	copy(zero[32:], make([]byte, 16))
+	if _, err := StatsFromPacket(zero, sent); err == nil {
+		t.Error("no error for a packet without receive and transmit times")
+	}
+}
+
+func TestNow(t *testing.T) {
+	s := NtpStats{Offset: time.Hour}
+	before := time.Now()
+	a := s.Now()
+	b := s.Now()
+	after := time.Now()
+
+	// The monotonic reading is kept, and Round(0) strips it.
+	if !strings.Contains(a.String(), " m=") {
+		t.Errorf("Now() = %v, want a monotonic clock reading", a)
+	}
+	if strings.Contains(a.Round(0).String(), " m=") {
+		t.Errorf("Now().Round(0) = %v, want no monotonic clock reading", a.Round(0))
+	}
+	if a.Before(before.Add(time.Hour)) || a.After(after.Add(time.Hour)) {
+		t.Errorf("Now() = %v, want an hour after %v", a, before)
+	}
+	if d := b.Sub(a); d < 0 || d > after.Sub(before) {
+		t.Errorf("Now() readings %v apart, want at most %v", d, after.Sub(before))
+	}
+}
+
+func TestCorrectedOriginTime(t *testing.T) {
+	s := NtpStats{OriginTime: t0, Offset: -1500 * ms}
+	if got, want := s.CorrectedOriginTime(), t0.Add(-1500*ms); !got.Equal(want) {
+		t.Errorf("CorrectedOriginTime() = %v, want %v", got, want)
+	}
+
+	// A stored and reloaded sample gives the same instant.
+	srv := newServer(t, ntptest.Reply{Stratum: 2, Offset: time.Hour})
+	stats, err := QueryWithOptions(srv.Host, QueryOptions{Port: srv.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := stats.MarshalBinary()
+	var loaded NtpStats
+	if err := loaded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	got := loaded.CorrectedOriginTime()
+	if !got.Equal(stats.CorrectedOriginTime()) {
+		t.Errorf("reloaded sample corrected to %v, want %v", got, stats.CorrectedOriginTime())
+	}
+	// The server received the request at about the corrected origin time.
+	if d := got.Sub(stats.ReceiveTime); d < -5*ms || d > 5*ms {
+		t.Errorf("corrected origin time %v off the server's receive time", d)
+	}
+}
+
+func TestUnsynchronizedAndKiss(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 16})
+	opt := QueryOptions{Port: s.Port}
+
+	_, err := QueryWithOptions(s.Host, opt)
+	var kod *KissOfDeathError
+	if !errors.Is(err, ErrUnsynchronizedServer) || errors.As(err, &kod) {
+		t.Errorf("stratum 16: err = %v, want ErrUnsynchronizedServer", err)
+	}
+
+	s.SetReply(ntptest.Reply{Stratum: 0, ReferenceID: "RATE"})
+	_, err = QueryWithOptions(s.Host, opt)
+	if !errors.As(err, &kod) || kod.Code != "RATE" || errors.Is(err, ErrUnsynchronizedServer) {
+		t.Errorf("stratum 0: err = %v, want a RATE kiss-o'-death", err)
+	}
+}
+
+func TestRandomAddr(t *testing.T) {
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = f }(lookupIPAddr)
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{
+			{IP: net.ParseIP("2001:db8::1")},
+			{IP: net.IPv4(192, 0, 2, 1)},
+			{IP: net.IPv4(192, 0, 2, 2)},
+			{IP: net.IPv4(192, 0, 2, 3)},
+		}, nil
+	}
+
+	// Without RandomAddr the first IPv4 address is always picked.
+	for i := 0; i < 10; i++ {
+		addrs, err := resolve(context.Background(), "pool.example", QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0].String() != "192.0.2.1:123" {
+			t.Fatalf("resolve() = %v, want [192.0.2.1:123]", addrs)
+		}
+	}
+
+	const n = 400
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		addrs, err := resolve(context.Background(), "pool.example", QueryOptions{RandomAddr: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[addrs[0].IP.String()]++
+	}
+	if len(counts) != 4 {
+		t.Fatalf("addresses picked: %v, want all four", counts)
+	}
+	// Each is expected 100 times; 50 is far out in the tail.
+	for ip, c := range counts {
+		if c < n/8 {
+			t.Errorf("%s picked %d times of %d, want about %d", ip, c, n, n/4)
+		}
+	}
+}
+
+func TestServerProcessingDelay(t *testing.T) {
+	for _, held := range []time.Duration{0, 1500 * time.Microsecond, 250 * ms} {
+		t2 := t0.Add(10 * ms)
+		b := encodeMsg(serverMsg(t0, t2, t2.Add(held)))
+		stats, err := StatsFromPacket(b, t0.Add(20*ms+held))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.ServerProcessingDelay != held {
+			t.Errorf("ServerProcessingDelay = %v, want %v", stats.ServerProcessingDelay, held)
+		}
+		if d := stats.TransmitTime.Sub(stats.ReceiveTime); stats.ServerProcessingDelay != d {
+			t.Errorf("ServerProcessingDelay = %v, transmit minus receive time %v", stats.ServerProcessingDelay, d)
+		}
+		if stats.Delay != 20*ms {
+			t.Errorf("held %v: Delay = %v, want 20ms", held, stats.Delay)
+		}
+	}
+}
+
+func TestFallbackDeadline(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+
+	// Three pool members on the server's port that never answer.
+	var dead []net.IPAddr
+	for i := 2; i <= 4; i++ {
+		ip := net.IPv4(127, 0, 0, byte(i))
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: s.Port})
+		if err != nil {
+			t.Skipf("cannot listen on the loopback network: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		dead = append(dead, net.IPAddr{IP: ip})
+	}
+	live := net.IPAddr{IP: net.ParseIP(s.Host)}
+
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = f }(lookupIPAddr)
+	var ips []net.IPAddr
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) { return ips, nil }
+
+	tests := []struct {
+		name     string
+		live     bool
+		opt      QueryOptions
+		min, max time.Duration
+	}{
+		// All dead: the attempt's timeout bounds the total.
+		{"all dead", false, QueryOptions{Timeout: 300 * ms}, 300 * ms, 500 * ms},
+		// Each dead address gets a quarter of the timeout.
+		{"even share", true, QueryOptions{Timeout: 400 * ms}, 300 * ms, 400 * ms},
+		{"AddrTimeout", true, QueryOptions{Timeout: time.Second, AddrTimeout: 50 * ms}, 150 * ms, 400 * ms},
+	}
+	for _, tt := range tests {
+		ips = dead
+		if tt.live {
+			ips = append(dead[:len(dead):len(dead)], live)
+		}
+		opt := tt.opt
+		opt.Port, opt.Fallback = s.Port, true
+
+		start := time.Now()
+		stats, err := QueryWithOptions("pool.example", opt)
+		elapsed := time.Since(start)
+		if tt.live && (err != nil || !stats.FallbackAddr) {
+			t.Errorf("%s: err = %v, FallbackAddr = %v, want a reply from the last address", tt.name, err, stats.FallbackAddr)
+		}
+		if !tt.live && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		if elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("%s: took %v, want between %v and %v", tt.name, elapsed, tt.min, tt.max)
+		}
+	}
+}
+
+func TestInterleaved(t *testing.T) {
+	// The server's clock agrees with ours and each leg takes 10ms.  It
+	// put 11ms in its first reply but the packet left at 12ms, as its
+	// second reply reports.
+	b := encodeMsg(serverMsg(t0, t0.Add(10*ms), t0.Add(11*ms)))
+	prev, err := StatsFromPacket(b, t0.Add(22*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1 := t0.Add(time.Second)
+	b = encodeMsg(serverMsg(t1, t1.Add(10*ms), t0.Add(12*ms)))
+	cur, err := StatsFromPacket(b, t1.Add(20*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prev.Offset != -500*time.Microsecond || prev.Delay != 21*ms {
+		t.Fatalf("basic offset %v and delay %v, want -0.5ms and 21ms", prev.Offset, prev.Delay)
+	}
+	s := Interleaved(prev, cur)
+	if s.Offset != 0 || s.Delay != 20*ms || s.ServerProcessingDelay != 2*ms {
+		t.Errorf("interleaved offset %v, delay %v, processing delay %v, want 0, 20ms and 2ms",
+			s.Offset, s.Delay, s.ServerProcessingDelay)
+	}
+	if !s.OriginTime.Equal(prev.OriginTime) || !s.ReceiveTime.Equal(prev.ReceiveTime) ||
+		!s.DestinationTime.Equal(prev.DestinationTime) || !s.TransmitTime.Equal(cur.TransmitTime) {
+		t.Errorf("timestamps paired as %v %v %v %v", s.OriginTime, s.ReceiveTime, s.TransmitTime, s.DestinationTime)
+	}
+}
+
+// closedPort returns a loopback UDP port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+// rawServer answers each request arriving on a loopback port with the
+// packets respond returns for it, and returns the port.  It stands in for
+// servers misbehaving in ways ntptest does not model.
+func rawServer(t *testing.T, respond func(req []byte) [][]byte) int {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, b := range respond(buf[:n]) {
+				c.WriteToUDP(b, addr)
+			}
+		}
+	}()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestTransportErrorPhase(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = f }(lookupIPAddr)
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host == "missing.example" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+
+	tests := []struct {
+		name  string
+		host  string
+		opt   QueryOptions
+		phase string
+		check func(error) bool
+	}{
+		{"resolve", "missing.example", QueryOptions{}, "resolve", func(err error) bool {
+			var de *net.DNSError
+			return errors.As(err, &de) && de.IsNotFound
+		}},
+		{"dial", "127.0.0.1", QueryOptions{LocalAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}}, "dial", func(err error) bool {
+			var oe *net.OpError
+			return errors.As(err, &oe) && oe.Op == "dial"
+		}},
+		{"refused", "127.0.0.1", QueryOptions{Port: closedPort(t)}, "read", func(err error) bool {
+			var oe *net.OpError
+			return errors.As(err, &oe) && errors.Is(err, ErrConnectionRefused)
+		}},
+		{"timeout", "127.0.0.1", QueryOptions{Port: silent.LocalAddr().(*net.UDPAddr).Port, Timeout: 50 * ms}, "read", func(err error) bool {
+			var ne net.Error
+			return errors.As(err, &ne) && ne.Timeout()
+		}},
+	}
+	for _, tt := range tests {
+		_, err := QueryWithOptions(tt.host, tt.opt)
+		var te *TransportError
+		if !errors.As(err, &te) || te.Phase != tt.phase {
+			t.Errorf("%s: err = %v, want a TransportError in phase %s", tt.name, err, tt.phase)
+			continue
+		}
+		if !tt.check(err) {
+			t.Errorf("%s: err = %v (%T) does not wrap the expected cause", tt.name, err, te.Err)
+		}
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	times := []time.Time{
+		time.Date(1968, 1, 20, 3, 14, 8, 0, time.UTC), // start of the decoded range
+		time.Unix(0, 0).UTC(),
+		time.Date(2000, 2, 29, 23, 59, 59, 999999999, time.UTC),
+		t0,
+		time.Date(2036, 2, 7, 6, 28, 15, 999999999, time.UTC), // end of era 0
+		time.Date(2036, 2, 7, 6, 28, 16, 1, time.UTC),         // start of era 1
+		time.Date(2104, 2, 26, 9, 42, 23, 500000000, time.UTC),
+	}
+	for i := int64(0); i < 1000; i++ {
+		// Spread over the range, with varied fractions.
+		times = append(times, times[0].Add(time.Duration(i*4294967*1e9+i*i*7919)))
+	}
+	for _, tm := range times {
+		b := TimeToNTP(tm)
+		if got := NTPToTime(b); !got.Equal(tm) {
+			t.Errorf("%v encodes as %x, decoded as %v", tm, b, got)
+		}
+		if got := Timestamp(binary.BigEndian.Uint64(b[:])).Time(); !got.Equal(tm) {
+			t.Errorf("Timestamp(%x).Time() = %v, want %v", b, got, tm)
+		}
+	}
+
+	// The Unix epoch is 2208988800 seconds into era 0, and half a second
+	// is exactly half the fraction.
+	if b := TimeToNTP(time.Unix(0, 5e8)); b != [8]byte{0x83, 0xaa, 0x7e, 0x80, 0x80, 0, 0, 0} {
+		t.Errorf("TimeToNTP(Unix epoch + 0.5s) = %x, want 83aa7e8080000000", b)
+	}
+	if tm := NTPToTime([8]byte{}); !tm.Equal(time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("NTPToTime(0) = %v, want 1900-01-01", tm)
+	}
+}
+
+// recordingSink records the stats it is given.
+type recordingSink struct{ stats []NtpStats }
+
+func (s *recordingSink) Apply(offset time.Duration, stats NtpStats) {
+	if offset != stats.Offset {
+		panic("Sink given an offset other than that of the stats")
+	}
+	s.stats = append(s.stats, stats)
+}
+
+func TestSink(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2, Offset: time.Hour})
+	sink := &recordingSink{}
+	opt := QueryOptions{Port: s.Port, Sink: sink}
+
+	stats, err := QueryWithOptions(s.Host, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.stats) != 1 || !sink.stats[0].TransmitTime.Equal(stats.TransmitTime) {
+		t.Fatalf("sink given %d results, want the query's", len(sink.stats))
+	}
+
+	// Failed queries are not passed on.
+	s.SetReply(ntptest.Reply{Stratum: 16})
+	if _, err := QueryWithOptions(s.Host, opt); err == nil {
+		t.Fatal("no error from an unsynchronized server")
+	}
+	if len(sink.stats) != 1 {
+		t.Errorf("sink given %d results after a failed query, want 1", len(sink.stats))
+	}
+
+	opt.Sink = NopSink
+	s.SetReply(ntptest.Reply{Stratum: 2})
+	if _, err := QueryWithOptions(s.Host, opt); err != nil {
+		t.Errorf("query with NopSink: %v", err)
+	}
+}
+
+func TestTotalBudget(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// Without the budget the retries would take a second.
+	opt := QueryOptions{Port: silent.LocalAddr().(*net.UDPAddr).Port, Timeout: 200 * ms, Retries: 4, TotalBudget: 300 * ms}
+	start := time.Now()
+	_, err = QueryWithOptions("127.0.0.1", opt)
+	elapsed := time.Since(start)
+	if !isTimeout(err) {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+	if elapsed < 300*ms || elapsed > 500*ms {
+		t.Errorf("query took %v, want about 300ms", elapsed)
+	}
+
+	// A budget too small for the first attempt fails it, even against a
+	// live server, rather than returning empty stats.
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	if stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, TotalBudget: 1}); err == nil {
+		t.Errorf("1ns budget: no error, stats %+v", stats)
+	}
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, TotalBudget: time.Second}); err != nil {
+		t.Errorf("1s budget: %v", err)
+	}
+}
+
+func TestEffectiveDispersion(t *testing.T) {
+	// The server last synchronized 1000s before answering, allowing 15ms
+	// of drift at 15 ppm.
+	m := serverMsg(t0, t0.Add(10*ms), t0.Add(11*ms))
+	m.ReferenceTime = toNtpTime(t0.Add(11*ms - 1000*time.Second))
+	m.RootDispersion = 0x00000290 // 10.01ms
+	m.Precision = 0xec            // -20
+	stats, err := StatsFromPacket(encodeMsg(m), t0.Add(21*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := stats.RootDispersion + stats.Precision + 15*ms; stats.EffectiveDispersion() != want {
+		t.Errorf("EffectiveDispersion() = %v, want %v", stats.EffectiveDispersion(), want)
+	}
+
+	// Without a reference time no drift is allowed for.
+	m.ReferenceTime = ntpTime{}
+	stats, err = StatsFromPacket(encodeMsg(m), t0.Add(21*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := stats.RootDispersion + stats.Precision; stats.EffectiveDispersion() != want {
+		t.Errorf("EffectiveDispersion() without reference time = %v, want %v", stats.EffectiveDispersion(), want)
+	}
+
+	// An absurd precision saturates rather than wrapping negative.
+	m.Precision = 127
+	stats, err = StatsFromPacket(encodeMsg(m), t0.Add(21*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := stats.EffectiveDispersion(); d != math.MaxInt64 {
+		t.Errorf("EffectiveDispersion() with precision 2^127 = %v, want the longest Duration", d)
+	}
+}
+
+func TestReplyLenChecksum(t *testing.T) {
+	tests := []struct {
+		b   []byte
+		crc uint32
+	}{
+		{gpsReply, 0xbd670da0},
+		// The same with an empty extension word.
+		{append(append([]byte(nil), gpsReply...), 0, 0, 0, 0), 0xfb9b671b},
+	}
+	for _, tt := range tests {
+		stats, err := StatsFromPacket(tt.b, gpsSent.Add(125*ms))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.ReplyLen != len(tt.b) || stats.ReplyChecksum != tt.crc {
+			t.Errorf("ReplyLen %d, ReplyChecksum %#x, want %d and %#x", stats.ReplyLen, stats.ReplyChecksum, len(tt.b), tt.crc)
+		}
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	// A legacy server ignoring version 4 requests.
+	s := newServer(t, ntptest.Reply{Stratum: 2, OnlyVersion: 3})
+	opt := QueryOptions{Port: s.Port, Timeout: 100 * ms}
+
+	if _, err := QueryWithOptions(s.Host, opt); !isTimeout(err) {
+		t.Errorf("without Downgrade: err = %v, want a timeout", err)
+	}
+	opt.Downgrade = true
+	stats, err := QueryWithOptions(s.Host, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Downgraded || stats.Version != 3 {
+		t.Errorf("Downgraded %v, version %d, want a version 3 reply after downgrading", stats.Downgraded, stats.Version)
+	}
+
+	// One answering version 4 requests as version 3 only downgrades with
+	// Strict.
+	s.SetReply(ntptest.Reply{Stratum: 2, Version: 3})
+	stats, err = QueryWithOptions(s.Host, opt)
+	if err != nil || stats.Downgraded || !stats.VersionMismatch {
+		t.Errorf("mismatched version: err %v, Downgraded %v, VersionMismatch %v, want the reply accepted as is",
+			err, stats.Downgraded, stats.VersionMismatch)
+	}
+	opt.Strict = true
+	stats, err = QueryWithOptions(s.Host, opt)
+	if err != nil || !stats.Downgraded {
+		t.Errorf("mismatched version with Strict: err %v, Downgraded %v, want a downgrade", err, stats.Downgraded)
+	}
+
+	// A version 4 server is not downgraded from.
+	s.SetReply(ntptest.Reply{Stratum: 2})
+	if stats, err := QueryWithOptions(s.Host, opt); err != nil || stats.Downgraded || stats.Version != 4 {
+		t.Errorf("version 4 server: err %v, Downgraded %v, version %d", err, stats.Downgraded, stats.Version)
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	tests := []struct {
+		offset, delay time.Duration
+		o, d          float64
+	}{
+		{0, 0, 0, 0},
+		{1500 * ms, 20 * ms, 1.5, 0.02},
+		{-250 * time.Microsecond, time.Nanosecond, -0.00025, 1e-9},
+		{-3 * time.Hour, 2 * time.Second, -10800, 2},
+	}
+	for _, tt := range tests {
+		s := NtpStats{Offset: tt.offset, Delay: tt.delay}
+		if got := s.OffsetSeconds(); got != tt.o {
+			t.Errorf("OffsetSeconds() of %v = %v, want %v", tt.offset, got, tt.o)
+		}
+		if got := s.DelaySeconds(); got != tt.d {
+			t.Errorf("DelaySeconds() of %v = %v, want %v", tt.delay, got, tt.d)
+		}
+	}
+}
+
+func TestMaxReplyLen(t *testing.T) {
+	// A 200 byte extension field after the header, as NTS servers send.
+	ext := make([]byte, 200)
+	binary.BigEndian.PutUint16(ext[0:], 0x0104)
+	binary.BigEndian.PutUint16(ext[2:], uint16(len(ext)))
+	s := newServer(t, ntptest.Reply{Stratum: 2, Trailer: func(req, header []byte) []byte { return ext }})
+
+	tests := []struct {
+		max       int
+		len       int
+		truncated bool
+	}{
+		{0, 72, true},
+		{100, 100, true},
+		{headerLen + len(ext), headerLen + len(ext), false},
+		{1024, headerLen + len(ext), false},
+	}
+	for _, tt := range tests {
+		stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, MaxReplyLen: tt.max})
+		if err != nil {
+			t.Errorf("MaxReplyLen %d: %v", tt.max, err)
+			continue
+		}
+		if stats.ReplyLen != tt.len || stats.Truncated != tt.truncated || stats.Class != PacketExtended {
+			t.Errorf("MaxReplyLen %d: ReplyLen %d, Truncated %v, Class %v, want %d, %v, extended",
+				tt.max, stats.ReplyLen, stats.Truncated, stats.Class, tt.len, tt.truncated)
+		}
+	}
+
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, MaxReplyLen: 47}); err == nil {
+		t.Error("no error for MaxReplyLen 47")
+	}
+	key := &SymmetricKey{ID: 1, Type: AuthSHA1, Key: []byte("secret")}
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, Auth: key}); err == nil {
+		t.Error("no error for a truncated authenticated reply")
+	}
+}
+
+func TestCoarseClock(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	opt := QueryOptions{Port: s.Port}
+
+	stats, err := QueryWithOptions(s.Host, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CoarseClock || stats.ClockResolution != 0 {
+		t.Errorf("CoarseClock %v, ClockResolution %v with a fine clock", stats.CoarseClock, stats.ClockResolution)
+	}
+
+	// A clock stuck between ticks reads the same when the request is sent
+	// and when the reply arrives.
+	defer func(f func() time.Time) { now = f }(now)
+	tick := time.Now().Round(0)
+	now = func() time.Time { return tick }
+
+	stats, err = QueryWithOptions(s.Host, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.CoarseClock || stats.ClockResolution <= 0 {
+		t.Fatalf("CoarseClock %v, ClockResolution %v, want a coarse clock", stats.CoarseClock, stats.ClockResolution)
+	}
+	if !stats.OriginTime.Equal(stats.DestinationTime) || stats.Delay != 0 {
+		t.Errorf("T1 %v, T4 %v, Delay %v, want identical times and no delay", stats.OriginTime, stats.DestinationTime, stats.Delay)
+	}
+	if d := stats.RootDistance(); d < stats.ClockResolution {
+		t.Errorf("RootDistance() = %v, want at least the clock resolution %v", d, stats.ClockResolution)
+	}
+}
+
+func TestModeString(t *testing.T) {
+	names := []string{"reserved", "symmetric active", "symmetric passive", "client", "server", "broadcast", "control", "private"}
+	for md, name := range names {
+		if s := Mode(md).String(); s != name {
+			t.Errorf("Mode(%d).String() = %q, want %q", md, s, name)
+		}
+	}
+	if s := Mode(8).String(); s != "Mode(8)" {
+		t.Errorf("Mode(8).String() = %q", s)
+	}
+	if ModeServer != 4 || ModeControl != 6 {
+		t.Errorf("ModeServer = %d and ModeControl = %d, want 4 and 6", ModeServer, ModeControl)
+	}
+
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Mode != ModeServer {
+		t.Errorf("reply mode %v, want server", stats.Mode)
+	}
+}
+
+func TestRequestPacket(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	for _, version := range []byte{3, 4} {
+		stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := stats.RequestPacket
+		if len(b) != headerLen {
+			t.Fatalf("request of %d bytes, want %d", len(b), headerLen)
+		}
+		var m msg
+		if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &m); err != nil {
+			t.Fatal(err)
+		}
+		if v, mode := (m.LiVnMode>>3)&0x07, Mode(m.LiVnMode&0x07); v != version || mode != ModeClient {
+			t.Errorf("request version %d, mode %v, want %d and client", v, mode, version)
+		}
+		// The transmit time is the origin time the server echoed.
+		if xmit := m.TransmitTime.UTC(); !xmit.Equal(stats.OriginTime) {
+			t.Errorf("request transmit time %v, want the origin time %v", xmit, stats.OriginTime)
+		}
+	}
+}
+
+func TestShortFormat(t *testing.T) {
+	tests := []struct {
+		v uint32
+		d time.Duration
+	}{
+		{0, 0},
+		{0x00000001, 15258 * time.Nanosecond},
+		{0x00004000, 250 * ms},
+		{0x00008000, 500 * ms},
+		{0x00010000, time.Second},
+		{0x00018000, 1500 * ms},
+		{0x00100000, 16 * time.Second},
+	}
+	for _, tt := range tests {
+		if d := ShortToDuration(tt.v); d != tt.d {
+			t.Errorf("ShortToDuration(%#08x) = %v, want %v", tt.v, d, tt.d)
+		}
+		if v := DurationToShort(tt.d); v != tt.v {
+			t.Errorf("DurationToShort(%v) = %#08x, want %#08x", tt.d, v, tt.v)
+		}
+	}
+
+	// Every value survives the round trip.
+	for v := uint32(0); v < 1<<20; v += 7 {
+		if got := DurationToShort(ShortToDuration(v)); got != v {
+			t.Fatalf("%#08x round trips to %#08x", v, got)
+		}
+	}
+	if got := DurationToShort(ShortToDuration(math.MaxUint32)); got != math.MaxUint32 {
+		t.Errorf("%#08x round trips to %#08x", uint32(math.MaxUint32), got)
+	}
+
+	if v := DurationToShort(-time.Second); v != 0 {
+		t.Errorf("DurationToShort(-1s) = %#08x, want 0", v)
+	}
+	if v := DurationToShort(100000 * time.Second); v != math.MaxUint32 {
+		t.Errorf("DurationToShort(100000s) = %#08x, want %#08x", v, uint32(math.MaxUint32))
+	}
+}
+
+// bufferRecorder records the socket buffer sizes set on it, failing with
+// err if set.
+type bufferRecorder struct {
+	read, write int
+	err         error
+}
+
+func (b *bufferRecorder) SetReadBuffer(n int) error {
+	b.read = n
+	return b.err
+}
+
+func (b *bufferRecorder) SetWriteBuffer(n int) error {
+	b.write = n
+	return b.err
+}
+
+func TestSocketBuffers(t *testing.T) {
+	tests := []struct {
+		read, write int
+	}{
+		{0, 0},
+		{1 << 20, 0},
+		{0, 65536},
+		{262144, 131072},
+	}
+	for _, tt := range tests {
+		var b bufferRecorder
+		if err := setBuffers(&b, QueryOptions{ReadBuffer: tt.read, WriteBuffer: tt.write}); err != nil {
+			t.Fatal(err)
+		}
+		if b.read != tt.read || b.write != tt.write {
+			t.Errorf("set read %d and write %d, want %d and %d", b.read, b.write, tt.read, tt.write)
+		}
+	}
+
+	failed := errors.New("no buffer space")
+	if err := setBuffers(&bufferRecorder{err: failed}, QueryOptions{ReadBuffer: 1}); err != failed {
+		t.Errorf("err = %v, want the setter's", err)
+	}
+
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, ReadBuffer: 65536, WriteBuffer: 65536}); err != nil {
+		t.Errorf("query with buffer sizes: %v", err)
+	}
+	for _, opt := range []QueryOptions{{Port: s.Port, ReadBuffer: -1}, {Port: s.Port, WriteBuffer: -1}} {
+		if _, err := QueryWithOptions(s.Host, opt); err == nil {
+			t.Errorf("no error for buffer sizes %d and %d", opt.ReadBuffer, opt.WriteBuffer)
+		}
+	}
+}
+
+func TestInAgreement(t *testing.T) {
+	// A root distance of 10ms: half of 4ms of delay and 8ms of dispersion.
+	base := NtpStats{Delay: 4 * ms, RootDispersion: 8 * ms}
+	tests := []struct {
+		offset time.Duration
+		want   bool
+	}{
+		{0, true},
+		{10*ms - 1, true},
+		{10 * ms, true},
+		{10*ms + 1, false},
+		{-10 * ms, true},
+		{-10*ms - 1, false},
+		{time.Second, false},
+	}
+	for _, tt := range tests {
+		s := base
+		s.Offset = tt.offset
+		if got := s.InAgreement(); got != tt.want {
+			t.Errorf("InAgreement() with offset %v = %v, want %v", tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestRawTimestamps(t *testing.T) {
+	// Fractions below a nanosecond survive only in the raw values.
+	b := append([]byte(nil), gpsReply...)
+	for i := 16; i < 48; i += 8 {
+		b[i+7] |= 0x01
+	}
+	stats, err := StatsFromPacket(b, gpsSent.Add(125*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		name string
+		raw  Timestamp
+		off  int
+	}{
+		{"reference", stats.RawReferenceTime, 16},
+		{"origin", stats.RawOriginTime, 24},
+		{"receive", stats.RawReceiveTime, 32},
+		{"transmit", stats.RawTransmitTime, 40},
+	} {
+		if want := Timestamp(binary.BigEndian.Uint64(b[f.off:])); f.raw != want {
+			t.Errorf("raw %s time %#016x, want %#016x", f.name, uint64(f.raw), uint64(want))
+		}
+	}
+	if !stats.RawTransmitTime.Time().Equal(stats.TransmitTime) {
+		t.Errorf("raw transmit time decodes as %v, want %v", stats.RawTransmitTime.Time(), stats.TransmitTime)
+	}
+
+	// A live query captures the same values as the reply carries.
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	live, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xmit := TimeToNTP(live.OriginTime); live.RawOriginTime != Timestamp(binary.BigEndian.Uint64(xmit[:])) {
+		t.Errorf("raw origin time %#016x, want the request's %x", uint64(live.RawOriginTime), xmit)
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = f }(lookupIPAddr)
+
+	// A resolver taking delay to answer, or until it is cancelled.
+	var delay time.Duration
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		select {
+		case <-time.After(delay):
+			return []net.IPAddr{{IP: net.ParseIP(s.Host)}}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	tests := []struct {
+		delay, resolveTimeout time.Duration
+		ok                    bool
+		max                   time.Duration
+	}{
+		{time.Hour, 50 * ms, false, 300 * ms},
+		// The slow answer does not eat into the exchange's timeout.
+		{150 * ms, 300 * ms, true, time.Second},
+		// Without ResolveTimeout the query's Timeout applies.
+		{time.Hour, 0, false, 500 * ms},
+	}
+	for _, tt := range tests {
+		delay = tt.delay
+		start := time.Now()
+		_, err := QueryWithOptions("slow.example", QueryOptions{Port: s.Port, Timeout: 200 * ms, ResolveTimeout: tt.resolveTimeout})
+		elapsed := time.Since(start)
+
+		var te *TransportError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("resolver delay %v, ResolveTimeout %v: %v", tt.delay, tt.resolveTimeout, err)
+		case !tt.ok && (!errors.As(err, &te) || te.Phase != "resolve"):
+			t.Errorf("resolver delay %v, ResolveTimeout %v: err = %v, want a resolve error", tt.delay, tt.resolveTimeout, err)
+		}
+		if elapsed > tt.max {
+			t.Errorf("resolver delay %v, ResolveTimeout %v: took %v, want at most %v", tt.delay, tt.resolveTimeout, elapsed, tt.max)
+		}
+	}
+}
+
+func TestLookupPort(t *testing.T) {
+	defer func(f func(string, string) (int, error)) { lookupPort = f }(lookupPort)
+	var lookups int
+	var services map[string]int
+	lookupPort = func(network, service string) (int, error) {
+		lookups++
+		if p, ok := services[network+"/"+service]; ok {
+			return p, nil
+		}
+		return 0, errors.New("unknown port")
+	}
+
+	services = map[string]int{"udp/ntp": 10123}
+	tests := []struct {
+		opt  QueryOptions
+		want int
+	}{
+		{QueryOptions{}, 123},
+		{QueryOptions{LookupPort: true}, 10123},
+		{QueryOptions{LookupPort: true, Port: 4123}, 4123},
+		{QueryOptions{Port: 4123}, 4123},
+	}
+	for _, tt := range tests {
+		lookups = 0
+		if p := tt.opt.port(); p != tt.want {
+			t.Errorf("port() with Port %d, LookupPort %v = %d, want %d", tt.opt.Port, tt.opt.LookupPort, p, tt.want)
+		}
+		if used := tt.opt.LookupPort && tt.opt.Port == 0; (lookups > 0) != used {
+			t.Errorf("Port %d, LookupPort %v: %d lookups", tt.opt.Port, tt.opt.LookupPort, lookups)
+		}
+	}
+
+	services = nil
+	if p := (QueryOptions{LookupPort: true}).port(); p != 123 {
+		t.Errorf("port() without an ntp service = %d, want 123", p)
+	}
+
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	services = map[string]int{"udp/ntp": s.Port}
+	if _, err := QueryWithOptions(s.Host, QueryOptions{LookupPort: true}); err != nil {
+		t.Errorf("query on the looked up port: %v", err)
+	}
+}
+
+func TestFallbackFlags(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	live := net.IPAddr{IP: net.ParseIP(s.Host)}
+	// Nothing listens on the server's port at 127.0.0.2, so a query
+	// there is refused.
+	dead := net.IPAddr{IP: net.IPv4(127, 0, 0, 2)}
+
+	defer func(f func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = f }(lookupIPAddr)
+	var ips []net.IPAddr
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) { return ips, nil }
+
+	tests := []struct {
+		name     string
+		ips      []net.IPAddr
+		fallback bool
+		taken    bool
+	}{
+		{"first address answers", []net.IPAddr{live, dead}, true, false},
+		{"second address answers", []net.IPAddr{dead, live}, true, true},
+		{"single address", []net.IPAddr{live}, false, false},
+	}
+	for _, tt := range tests {
+		ips = tt.ips
+		stats, err := QueryWithOptions("pool.example", QueryOptions{Port: s.Port, Fallback: tt.fallback, Timeout: time.Second})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if stats.FallbackAddr != tt.taken || stats.Downgraded {
+			t.Errorf("%s: FallbackAddr %v, Downgraded %v, want %v and false", tt.name, stats.FallbackAddr, stats.Downgraded, tt.taken)
+		}
+	}
+
+	// Without Fallback only the first address is tried.
+	ips = []net.IPAddr{dead, live}
+	if _, err := QueryWithOptions("pool.example", QueryOptions{Port: s.Port, Timeout: time.Second}); err == nil {
+		t.Error("no error with the first address dead and Fallback off")
+	}
+}
+
+func TestReference(t *testing.T) {
+	// The server is 500ms ahead of the local clock and the reference 200ms
+	// ahead of it, so the server is 300ms ahead of true time.
+	s := newServer(t, ntptest.Reply{Stratum: 2, Offset: 500 * ms})
+	reference := func() time.Time { return time.Now().Add(200 * ms) }
+
+	stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, Reference: reference})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := stats.ServerError; e < 295*ms || e > 305*ms {
+		t.Errorf("ServerError = %v, want about 300ms", e)
+	}
+	if e := stats.Offset - stats.ServerError; e < 195*ms || e > 205*ms {
+		t.Errorf("Offset - ServerError = %v, want the local clock's error of about 200ms", e)
+	}
+
+	stats, err = QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ServerError != 0 {
+		t.Errorf("ServerError = %v without a reference, want 0", stats.ServerError)
+	}
+}
+
+func TestRawLiVnMode(t *testing.T) {
+	sent := make(chan byte, 1)
+	s := newServer(t, ntptest.Reply{Stratum: 2, Version: 4, Trailer: func(req, header []byte) []byte {
+		sent <- req[0]
+		return nil
+	}})
+
+	// An alarm leap indicator, version 7 and mode 0 are all sent as is.
+	for _, b := range []byte{0xe3, 0x3b, 0x20, 0x00} {
+		if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, RawLiVnMode: true, LiVnMode: b}); err != nil {
+			t.Errorf("first byte %#02x: %v", b, err)
+		}
+		if got := <-sent; got != b {
+			t.Errorf("first byte sent %#02x, want %#02x", got, b)
+		}
+	}
+
+	// By default, and with LiVnMode but not RawLiVnMode, the request is a
+	// version 4 client request.
+	for _, opt := range []QueryOptions{{Port: s.Port}, {Port: s.Port, LiVnMode: 0xe3}} {
+		if _, err := QueryWithOptions(s.Host, opt); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-sent; got != 0x23 {
+			t.Errorf("first byte sent %#02x with LiVnMode %#02x, want 0x23", got, opt.LiVnMode)
+		}
+	}
+}
+
+func TestQueryPacketConn(t *testing.T) {
+	con, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	// Several targets served in turn over the one socket.
+	var targets []*net.UDPAddr
+	for stratum := byte(1); stratum <= 3; stratum++ {
+		s := newServer(t, ntptest.Reply{Stratum: stratum, Offset: time.Duration(stratum) * time.Second})
+		targets = append(targets, &net.UDPAddr{IP: net.ParseIP(s.Host), Port: s.Port})
+	}
+	sink := &recordingSink{}
+	for round := 0; round < 2; round++ {
+		for i, raddr := range targets {
+			stats, err := QueryPacketConn(con, raddr, QueryOptions{Sink: sink})
+			if err != nil {
+				t.Fatalf("target %d: %v", i, err)
+			}
+			want := time.Duration(i+1) * time.Second
+			if stats.Stratum != byte(i+1) || stats.Offset < want-100*ms || stats.Offset > want+100*ms {
+				t.Errorf("target %d: stratum %d, offset %v, want the reply of that target", i, stats.Stratum, stats.Offset)
+			}
+			if stats.RemoteAddr.String() != raddr.String() || stats.LocalAddr.String() != con.LocalAddr().String() {
+				t.Errorf("target %d: addresses %v to %v", i, stats.LocalAddr, stats.RemoteAddr)
+			}
+		}
+	}
+	if len(sink.stats) != 2*len(targets) {
+		t.Errorf("Sink given %d results, want %d", len(sink.stats), 2*len(targets))
+	}
+
+	// A valid reply to the request coming from a second socket is
+	// discarded, and the query retried and failed as answered by the
+	// wrong server.
+	decoy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	requests := make(chan []byte, 10)
+	port := rawServer(t, func(req []byte) [][]byte {
+		requests <- req
+		now := time.Now()
+		m := serverMsg(now, now, now)
+		m.OriginTime = ntpTime{binary.BigEndian.Uint32(req[40:]), binary.BigEndian.Uint32(req[44:])}
+		decoy.WriteTo(encodeMsg(m), con.LocalAddr())
+		return nil
+	})
+	_, err = QueryPacketConn(con, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, QueryOptions{Timeout: 50 * ms, Retries: 2})
+	if !errors.Is(err, ErrWrongSource) {
+		t.Errorf("reply from the wrong address: err = %v, want ErrWrongSource", err)
+	}
+	if n := len(requests); n != 3 {
+		t.Errorf("%d requests sent with 2 retries, want 3", n)
+	}
+}
+
+func TestClassifyPacket(t *testing.T) {
+	tests := []struct {
+		len   int
+		class PacketClass
+		name  string
+	}{
+		{0, PacketShort, "short"},
+		{20, PacketShort, "short"},
+		{47, PacketShort, "short"},
+		{48, PacketPlain, "plain"},
+		{52, PacketAuthenticated, "authenticated"}, // crypto-NAK
+		{68, PacketAuthenticated, "authenticated"}, // MD5
+		{72, PacketAuthenticated, "authenticated"}, // SHA-1
+		{64, PacketExtended, "extended"},           // one 16 byte field
+		{84, PacketExtended, "extended"},           // a field and an MD5 MAC
+		{49, PacketExtended, "extended"},
+	}
+	for _, tt := range tests {
+		c := ClassifyPacket(make([]byte, tt.len))
+		if c != tt.class || c.String() != tt.name {
+			t.Errorf("ClassifyPacket(%d bytes) = %v, want %s", tt.len, c, tt.name)
+		}
+	}
+	if s := PacketClass(9).String(); s != "PacketClass(9)" {
+		t.Errorf("unknown class formatted as %q", s)
+	}
+
+	// The class of each reply is reported.
+	for _, tt := range []struct {
+		trailer int
+		class   PacketClass
+	}{{0, PacketPlain}, {20, PacketAuthenticated}, {16, PacketExtended}} {
+		n := tt.trailer
+		s := newServer(t, ntptest.Reply{Stratum: 2, Trailer: func(req, header []byte) []byte {
+			return make([]byte, n)
+		}})
+		stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+		if err != nil {
+			t.Fatalf("%d byte trailer: %v", tt.trailer, err)
+		}
+		if stats.Class != tt.class {
+			t.Errorf("%d byte trailer: Class = %v, want %v", tt.trailer, stats.Class, tt.class)
+		}
+	}
+}
+
+func TestSingleStamp(t *testing.T) {
+	// A server 5ms ahead stamping its reply once, midway through a 20ms
+	// round trip.
+	m := serverMsg(t0, t0.Add(15*ms), t0.Add(15*ms))
+	stats, err := computeStats(m, t0, t0.Add(20*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.SingleStamp || stats.Offset != 5*ms || stats.Delay != 20*ms {
+		t.Errorf("SingleStamp %v, offset %v, delay %v, want true, 5ms, 20ms", stats.SingleStamp, stats.Offset, stats.Delay)
+	}
+	m = serverMsg(t0, t0.Add(14*ms), t0.Add(16*ms))
+	if stats, _ := computeStats(m, t0, t0.Add(20*ms)); stats.SingleStamp {
+		t.Error("SingleStamp set for distinct receive and transmit times")
+	}
+
+	// A server leaving the receive time zero is only accepted with the
+	// option.
+	port := rawServer(t, func(req []byte) [][]byte {
+		now := time.Now().Add(time.Hour)
+		m := serverMsg(now, now, now)
+		m.OriginTime = ntpTime{binary.BigEndian.Uint32(req[40:]), binary.BigEndian.Uint32(req[44:])}
+		m.ReceiveTime = ntpTime{}
+		return [][]byte{encodeMsg(m)}
+	})
+	if _, err := QueryWithOptions("127.0.0.1", QueryOptions{Port: port}); err == nil {
+		t.Error("zero receive time accepted without SingleStamp")
+	}
+	stats, err = QueryWithOptions("127.0.0.1", QueryOptions{Port: port, SingleStamp: true, SpoofCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.SingleStamp || stats.RawReceiveTime != 0 || !stats.ReceiveTime.Equal(stats.TransmitTime) {
+		t.Errorf("SingleStamp %v, raw receive time %#x, receive time %v, want the transmit time standing in", stats.SingleStamp, stats.RawReceiveTime, stats.ReceiveTime)
+	}
+	if d := stats.Offset - time.Hour; d < -5*ms || d > 5*ms {
+		t.Errorf("offset %v, want about an hour", stats.Offset)
+	}
+}
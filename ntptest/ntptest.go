@@ -0,0 +1,211 @@
+// Package ntptest provides an NTP server for use in tests.  It answers
+// client requests on a local UDP port with a canned reply, so code using
+// package ntp can be exercised without reaching external servers.
+package ntptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reply describes the packet the server sends back.  The origin time is
+// always copied from the request's transmit time.
+type Reply struct {
+	Leap    byte
+	Version byte // if zero, the request's version is echoed
+	Stratum byte
+
+	// OnlyVersion, if non-zero, makes the server ignore requests of other
+	// versions, as some legacy servers do.  Ignored requests do not use
+	// up a reply set by SetReplies.
+	OnlyVersion byte
+
+	// ReferenceID is the reference identifier, or kiss code for stratum
+	// 0, as up to four ASCII characters.
+	ReferenceID string
+
+	Poll           int8
+	Precision      int8
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+
+	// ReferenceTime, ReceiveTime and TransmitTime are sent as is if set.
+	// An unset ReceiveTime or TransmitTime is filled with the current
+	// time shifted by Offset.
+	ReferenceTime time.Time
+	ReceiveTime   time.Time
+	TransmitTime  time.Time
+	Offset        time.Duration
+
+	// Delay holds each reply for that long before it is sent, as a
+	// distant or busy server would.  Requests are served concurrently.
+	Delay time.Duration
+
+	// Trailer, if set, is called with the whole request and the 48 byte
+	// header of the reply, and what it returns is appended to the reply,
+	// such as a MAC or extension fields.
+	Trailer func(req, header []byte) []byte
+}
+
+// A Server is an NTP server listening on the loopback interface.
+type Server struct {
+	// Host and Port are the address to query.
+	Host string
+	Port int
+
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	replies []Reply // the first answers the next request
+}
+
+// NewServer starts a server answering with r on a random loopback port.
+// The caller should call Close when finished.
+func NewServer(r Reply) (*Server, error) {
+	return NewServerAt("127.0.0.1:0", r)
+}
+
+// NewServerAt is like NewServer but listens on address, in host:port form.
+// Several servers on one port, at addresses such as 127.0.0.2 where the
+// platform routes the whole loopback network, stand in for the members of
+// a pool.
+func NewServerAt(address string, r Reply) (*Server, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	s := &Server{Host: addr.IP.String(), Port: addr.Port, conn: conn, replies: []Reply{r}}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the server address in host:port form.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// SetReply changes the reply sent to subsequent requests.
+func (s *Server) SetReply(r Reply) {
+	s.SetReplies(r)
+}
+
+// SetReplies makes the server answer subsequent requests with each of rs
+// in turn, repeating the last once the others are used up.  It panics if
+// rs is empty.
+func (s *Server) SetReplies(rs ...Reply) {
+	if len(rs) == 0 {
+		panic("ntptest: SetReplies with no reply")
+	}
+	s.mu.Lock()
+	s.replies = append([]Reply(nil), rs...)
+	s.mu.Unlock()
+}
+
+// Close shuts down the server and waits for it to stop.
+func (s *Server) Close() error {
+	err := s.conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 48 {
+			continue
+		}
+		received := time.Now()
+
+		s.mu.Lock()
+		r := s.replies[0]
+		if r.OnlyVersion != 0 && (buf[0]>>3)&0x07 != r.OnlyVersion {
+			s.mu.Unlock()
+			continue
+		}
+		if len(s.replies) > 1 {
+			s.replies = s.replies[1:]
+		}
+		s.mu.Unlock()
+
+		p := r.packet(buf[:n], received)
+		if r.Delay <= 0 {
+			s.conn.WriteToUDP(p, addr)
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			time.Sleep(r.Delay)
+			s.conn.WriteToUDP(p, addr)
+		}()
+	}
+}
+
+// packet builds the reply to request req received at t.
+func (r Reply) packet(req []byte, t time.Time) []byte {
+	version := r.Version
+	if version == 0 {
+		version = (req[0] >> 3) & 0x07
+	}
+
+	recv, xmit := r.ReceiveTime, r.TransmitTime
+	if recv.IsZero() {
+		recv = t.Add(r.Offset)
+	}
+	if xmit.IsZero() {
+		xmit = time.Now().Add(r.Offset)
+	}
+
+	var refID [4]byte
+	copy(refID[:], r.ReferenceID)
+
+	var b bytes.Buffer
+	b.WriteByte(r.Leap<<6 | version<<3 | 4) // server mode
+	b.WriteByte(r.Stratum)
+	b.WriteByte(byte(r.Poll))
+	b.WriteByte(byte(r.Precision))
+	binary.Write(&b, binary.BigEndian, toShort(r.RootDelay))
+	binary.Write(&b, binary.BigEndian, toShort(r.RootDispersion))
+	b.Write(refID[:])
+	binary.Write(&b, binary.BigEndian, toTimestamp(r.ReferenceTime))
+	b.Write(req[40:48]) // origin time
+	binary.Write(&b, binary.BigEndian, toTimestamp(recv))
+	binary.Write(&b, binary.BigEndian, toTimestamp(xmit))
+	if r.Trailer != nil {
+		b.Write(r.Trailer(req, b.Bytes()))
+	}
+	return b.Bytes()
+}
+
+// toTimestamp converts t to the 64 bit NTP timestamp format.  The zero
+// time converts to zero.
+func toTimestamp(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	sec := uint64(uint32(t.Unix() + 2208988800))
+	return sec<<32 | (uint64(t.Nanosecond())<<32+5e8)/1e9
+}
+
+// toShort converts d to the 32 bit NTP short format.
+func toShort(d time.Duration) uint32 {
+	return uint32(d.Seconds() * 65536)
+}
@@ -0,0 +1,199 @@
+package ntptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// exchange sends b to s and returns the reply, or nil if none arrives
+// within timeout.
+func exchange(t *testing.T, s *Server, b []byte, timeout time.Duration) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+// request returns a client request of the given version with transmit
+// timestamp xmit.
+func request(version byte, xmit uint64) []byte {
+	b := make([]byte, 48)
+	b[0] = version<<3 | 3
+	binary.BigEndian.PutUint64(b[40:], xmit)
+	return b
+}
+
+func TestServer(t *testing.T) {
+	ref := time.Date(2026, 10, 14, 11, 0, 0, 0, time.UTC)
+	recv := time.Date(2026, 10, 14, 12, 0, 0, 250e6, time.UTC)
+	xmit := recv.Add(time.Millisecond)
+	s, err := NewServer(Reply{
+		Leap:           1,
+		Stratum:        1,
+		ReferenceID:    "GPS",
+		Poll:           6,
+		Precision:      -20,
+		RootDelay:      500 * time.Millisecond,
+		RootDispersion: 250 * time.Millisecond,
+		ReferenceTime:  ref,
+		ReceiveTime:    recv,
+		TransmitTime:   xmit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b := exchange(t, s, request(4, 0x0123456789abcdef), time.Second)
+	if len(b) != 48 {
+		t.Fatalf("reply of %d bytes, want 48", len(b))
+	}
+	if b[0] != 1<<6|4<<3|4 {
+		t.Errorf("leap, version and mode %#x, want leap 1, version 4, server mode", b[0])
+	}
+	if b[1] != 1 || b[2] != 6 || int8(b[3]) != -20 {
+		t.Errorf("stratum, poll and precision %d, %d, %d, want 1, 6, -20", b[1], b[2], int8(b[3]))
+	}
+	if d := binary.BigEndian.Uint32(b[4:]); d != 0x8000 {
+		t.Errorf("root delay %#x, want 0x8000", d)
+	}
+	if d := binary.BigEndian.Uint32(b[8:]); d != 0x4000 {
+		t.Errorf("root dispersion %#x, want 0x4000", d)
+	}
+	if !bytes.Equal(b[12:16], []byte("GPS\x00")) {
+		t.Errorf("reference ID %q, want GPS", b[12:16])
+	}
+	for _, f := range []struct {
+		name string
+		off  int
+		want uint64
+	}{
+		{"reference", 16, toTimestamp(ref)},
+		{"origin", 24, 0x0123456789abcdef},
+		{"receive", 32, toTimestamp(recv)},
+		{"transmit", 40, toTimestamp(xmit)},
+	} {
+		if got := binary.BigEndian.Uint64(b[f.off:]); got != f.want {
+			t.Errorf("%s time %#x, want %#x", f.name, got, f.want)
+		}
+	}
+}
+
+func TestServerDefaults(t *testing.T) {
+	s, err := NewServer(Reply{Stratum: 2, Offset: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The request's version is echoed, and the times are the current time
+	// shifted by the offset.
+	before := time.Now().Add(time.Hour)
+	b := exchange(t, s, request(3, 1), time.Second)
+	after := time.Now().Add(time.Hour)
+	if b == nil {
+		t.Fatal("no reply")
+	}
+	if v := b[0] >> 3 & 7; v != 3 {
+		t.Errorf("version %d, want 3", v)
+	}
+	for _, off := range []int{32, 40} {
+		ts := binary.BigEndian.Uint64(b[off:])
+		if ts < toTimestamp(before.Truncate(time.Second)) || ts > toTimestamp(after.Add(time.Second)) {
+			t.Errorf("timestamp at %d is %#x, want between %#x and %#x", off, ts, toTimestamp(before), toTimestamp(after))
+		}
+	}
+
+	s.SetReply(Reply{Stratum: 16, Version: 4})
+	b = exchange(t, s, request(3, 1), time.Second)
+	if b == nil || b[1] != 16 || b[0]>>3&7 != 4 {
+		t.Errorf("after SetReply: reply %x, want stratum 16 and version 4", b)
+	}
+
+	if b := exchange(t, s, make([]byte, 40), 100*time.Millisecond); b != nil {
+		t.Errorf("reply %x to a short request", b)
+	}
+}
+
+func TestServerDelay(t *testing.T) {
+	s, err := NewServer(Reply{Stratum: 2, Delay: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	if b := exchange(t, s, request(4, 1), time.Second); b == nil {
+		t.Fatal("no reply")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("reply after %v, want at least 50ms", d)
+	}
+}
+
+func TestServerReplies(t *testing.T) {
+	s, err := NewServer(Reply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetReplies(Reply{Stratum: 1}, Reply{Stratum: 2}, Reply{Stratum: 3})
+	for _, want := range []byte{1, 2, 3, 3} {
+		b := exchange(t, s, request(4, 1), time.Second)
+		if b == nil || b[1] != want {
+			t.Errorf("reply %x, want stratum %d", b, want)
+		}
+	}
+}
+
+func TestServerTrailer(t *testing.T) {
+	got := make(chan []byte, 1)
+	s, err := NewServer(Reply{Trailer: func(req, header []byte) []byte {
+		got <- append([]byte(nil), req...)
+		return []byte{1, 2, 3, 4}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	req := append(request(4, 1), 0xaa, 0xbb, 0xcc, 0xdd)
+	b := exchange(t, s, req, time.Second)
+	if len(b) != 52 || !bytes.Equal(b[48:], []byte{1, 2, 3, 4}) {
+		t.Errorf("reply %x, want the trailer after the header", b)
+	}
+	if r := <-got; !bytes.Equal(r, req) {
+		t.Errorf("Trailer given request %x, want %x", r, req)
+	}
+}
+
+func TestServerOnlyVersion(t *testing.T) {
+	s, err := NewServer(Reply{Stratum: 2, OnlyVersion: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if b := exchange(t, s, request(4, 1), 100*time.Millisecond); b != nil {
+		t.Errorf("reply %x to a version 4 request", b)
+	}
+	if b := exchange(t, s, request(3, 1), time.Second); b == nil || b[0]>>3&7 != 3 {
+		t.Errorf("reply %x to a version 3 request, want version 3", b)
+	}
+}
@@ -0,0 +1,117 @@
+package ntp
+
+import (
+	"context"
+	"time"
+)
+
+// minOutlierMAD is the smallest median absolute deviation used when
+// detecting outliers, so that a run of near identical offsets does not
+// make every small change an outlier.
+const minOutlierMAD = 100 * time.Microsecond
+
+// minOutlierSamples is the number of samples needed before any is
+// considered an outlier.
+const minOutlierSamples = 4
+
+// PollOptions contains the parameters of a Poll session in addition to
+// those of each query.
+type PollOptions struct {
+	QueryOptions
+
+	// OutlierMADs, if non-zero, enables outlier detection: a sample
+	// whose offset lies more than OutlierMADs median absolute deviations
+	// from the median of the last OutlierWindow offsets is flagged.  If
+	// OutlierWindow is zero, 8 is used.
+	OutlierMADs   float64
+	OutlierWindow int
+
+	// DropOutliers makes Poll skip the callback for flagged samples.
+	DropOutliers bool
+}
+
+// A Sample is the outcome of one query in a Poll session.
+type Sample struct {
+	Stats NtpStats
+	Err   error
+
+	// Outlier is set if outlier detection flagged the offset.
+	Outlier bool
+}
+
+// Poll queries host every interval and calls fn with each sample until fn
+// returns false.  Failed queries are passed to fn with Err set.
+func Poll(host string, interval time.Duration, opt PollOptions, fn func(Sample) bool) {
+	PollContext(context.Background(), host, interval, opt, fn)
+}
+
+// PollContext is like Poll but also stops when ctx is done, without
+// calling fn for the query cut short.
+func PollContext(ctx context.Context, host string, interval time.Duration, opt PollOptions, fn func(Sample) bool) {
+	c := &Client{Host: host, Options: opt.QueryOptions, MinInterval: interval}
+	det := newOutlierDetector(opt.OutlierMADs, opt.OutlierWindow)
+
+	for {
+		s := Sample{}
+		s.Stats, s.Err = c.QueryContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if s.Err == nil {
+			s.Outlier = det.add(s.Stats.Offset)
+		}
+		if s.Outlier && opt.DropOutliers {
+			continue
+		}
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+// An outlierDetector flags offsets far from the median of recent ones,
+// measured in median absolute deviations.
+type outlierDetector struct {
+	k       float64
+	n       int
+	offsets []time.Duration
+}
+
+func newOutlierDetector(k float64, n int) *outlierDetector {
+	if n <= 0 {
+		n = 8
+	}
+	return &outlierDetector{k: k, n: n}
+}
+
+// add records offset and reports whether it is an outlier relative to the
+// offsets recorded before it.  Outliers are recorded too, so that a
+// lasting change of offset is accepted once it dominates the window.
+func (d *outlierDetector) add(offset time.Duration) bool {
+	outlier := false
+	if d.k > 0 && len(d.offsets) >= minOutlierSamples {
+		m := median(d.offsets)
+		dev := make([]time.Duration, len(d.offsets))
+		for i, o := range d.offsets {
+			dev[i] = abs(o - m)
+		}
+		mad := median(dev)
+		if mad < minOutlierMAD {
+			mad = minOutlierMAD
+		}
+		outlier = float64(abs(offset-m)) > d.k*float64(mad)
+	}
+
+	d.offsets = append(d.offsets, offset)
+	if len(d.offsets) > d.n {
+		d.offsets = d.offsets[len(d.offsets)-d.n:]
+	}
+	return outlier
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
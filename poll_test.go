@@ -0,0 +1,61 @@
+package ntp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestOutlierDetector(t *testing.T) {
+	d := newOutlierDetector(3, 8)
+	// Offsets scattered by about 1ms, with spikes at the 6th and 9th.
+	offsets := []time.Duration{10 * ms, 11 * ms, 9 * ms, 10 * ms, 11 * ms, 80 * ms, 10 * ms, 9 * ms, -40 * ms, 11 * ms}
+	for i, o := range offsets {
+		want := i == 5 || i == 8
+		if got := d.add(o); got != want {
+			t.Errorf("sample %d (%v): outlier = %v, want %v", i, o, got, want)
+		}
+	}
+
+	// Too few samples flag nothing, and a zero threshold disables it.
+	d = newOutlierDetector(3, 8)
+	for _, o := range []time.Duration{0, 0, time.Second} {
+		if d.add(o) {
+			t.Errorf("%v flagged before %d samples", o, minOutlierSamples)
+		}
+	}
+	d = newOutlierDetector(0, 8)
+	for _, o := range []time.Duration{0, 0, 0, 0, time.Second} {
+		if d.add(o) {
+			t.Errorf("%v flagged with detection disabled", o)
+		}
+	}
+}
+
+func TestPollOutliers(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	normal, spike := ntptest.Reply{Stratum: 2}, ntptest.Reply{Stratum: 2, Offset: time.Second}
+
+	for _, drop := range []bool{false, true} {
+		// The server's clock is a second ahead for the 6th reply only.
+		s.SetReplies(normal, normal, normal, normal, normal, spike, normal)
+		opt := PollOptions{QueryOptions: QueryOptions{Port: s.Port}, OutlierMADs: 20, DropOutliers: drop}
+
+		var samples []Sample
+		Poll(s.Host, time.Millisecond, opt, func(smp Sample) bool {
+			if smp.Err != nil {
+				t.Fatal(smp.Err)
+			}
+			samples = append(samples, smp)
+			return len(samples) < 8
+		})
+
+		for i, smp := range samples {
+			spiked := smp.Stats.Offset > 500*ms
+			if want := !drop && i == 5; smp.Outlier != want || spiked != want {
+				t.Errorf("DropOutliers %v, sample %d: Outlier = %v, offset %v", drop, i, smp.Outlier, smp.Stats.Offset)
+			}
+		}
+	}
+}
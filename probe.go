@@ -0,0 +1,118 @@
+package ntp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A VersionReport summarizes how a server answers queries of each
+// protocol version.
+type VersionReport struct {
+	V3, V4       NtpStats
+	V3Err, V4Err error
+
+	// Agree is set if both versions got valid replies whose offset
+	// confidence intervals overlap.
+	Agree bool
+}
+
+// ProbeVersions queries host with versions 3 and 4 concurrently and
+// reports the outcome of each.
+func ProbeVersions(host string, opt QueryOptions) VersionReport {
+	return ProbeVersionsContext(context.Background(), host, opt)
+}
+
+// ProbeVersionsContext is like ProbeVersions but gives up when ctx is
+// done, the unfinished queries failing with ctx.Err().
+func ProbeVersionsContext(ctx context.Context, host string, opt QueryOptions) VersionReport {
+	var r VersionReport
+	v3, v4 := opt, opt
+	v3.Version, v4.Version = 3, 4
+	v3.Downgrade, v4.Downgrade = false, false
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.V3, r.V3Err = QueryContext(ctx, host, v3)
+	}()
+	go func() {
+		defer wg.Done()
+		r.V4, r.V4Err = QueryContext(ctx, host, v4)
+	}()
+	wg.Wait()
+
+	r.Agree = r.V3Err == nil && r.V4Err == nil && Consistent(r.V3, r.V4)
+	return r
+}
+
+// A PairReport compares two queries of a server sent in quick succession.
+type PairReport struct {
+	First, Second NtpStats
+
+	// DelayDiff and OffsetDiff are the second reply's round trip delay
+	// and offset minus the first's.
+	DelayDiff  time.Duration
+	OffsetDiff time.Duration
+
+	// Divergent is set when either difference exceeds the threshold
+	// given to QueryPair, suggesting that the two exchanges took
+	// different network paths or reached different servers behind a
+	// load balancer.
+	Divergent bool
+}
+
+// QueryPair queries host twice in a row and compares the replies.
+// Replies are flagged Divergent if their delays or offsets differ by
+// more than threshold.
+func QueryPair(host string, opt QueryOptions, threshold time.Duration) (PairReport, error) {
+	return QueryPairContext(context.Background(), host, opt, threshold)
+}
+
+// QueryPairContext is like QueryPair but gives up, returning ctx.Err(),
+// when ctx is done.
+func QueryPairContext(ctx context.Context, host string, opt QueryOptions, threshold time.Duration) (PairReport, error) {
+	var r PairReport
+	var err error
+	if r.First, err = QueryContext(ctx, host, opt); err != nil {
+		return r, err
+	}
+	if r.Second, err = QueryContext(ctx, host, opt); err != nil {
+		return r, err
+	}
+	r.DelayDiff = r.Second.Delay - r.First.Delay
+	r.OffsetDiff = r.Second.Offset - r.First.Offset
+	r.Divergent = abs(r.DelayDiff) > threshold || abs(r.OffsetDiff) > threshold
+	return r, nil
+}
+
+// QueryInterfaces queries host concurrently from each of the local
+// addresses locals, such as those of the interfaces of a multi-homed host,
+// for comparing the offsets seen over each path.  The returned stats and
+// errors are in the same order as locals.  opt.LocalAddr is overridden.
+func QueryInterfaces(host string, locals []net.IP, opt QueryOptions) ([]NtpStats, []error) {
+	return QueryInterfacesContext(context.Background(), host, locals, opt)
+}
+
+// QueryInterfacesContext is like QueryInterfaces but gives up when ctx is
+// done, the unfinished queries failing with ctx.Err().
+func QueryInterfacesContext(ctx context.Context, host string, locals []net.IP, opt QueryOptions) ([]NtpStats, []error) {
+	stats := make([]NtpStats, len(locals))
+	errs := make([]error, len(locals))
+
+	var wg sync.WaitGroup
+	for i, ip := range locals {
+		wg.Add(1)
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			o := opt
+			o.LocalAddr = &net.UDPAddr{IP: ip}
+			stats[i], errs[i] = QueryContext(ctx, host, o)
+		}(i, ip)
+	}
+	wg.Wait()
+
+	return stats, errs
+}
@@ -0,0 +1,89 @@
+package ntp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestProbeVersions(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2, RootDispersion: 10 * ms, OnlyVersion: 3})
+	opt := QueryOptions{Port: s.Port, Timeout: 100 * ms, Downgrade: true}
+
+	// Downgrade is ignored, so the version 4 probe cannot succeed as
+	// version 3.
+	r := ProbeVersions(s.Host, opt)
+	if r.V3Err != nil || r.V3.Version != 3 {
+		t.Errorf("version 3: version %d, err %v", r.V3.Version, r.V3Err)
+	}
+	if !isTimeout(r.V4Err) || r.Agree {
+		t.Errorf("version 4: err %v, Agree %v, want a timeout and no agreement", r.V4Err, r.Agree)
+	}
+
+	s.SetReply(ntptest.Reply{Stratum: 2, RootDispersion: 10 * ms})
+	r = ProbeVersions(s.Host, opt)
+	if r.V3Err != nil || r.V4Err != nil || !r.Agree || r.V3.Version != 3 || r.V4.Version != 4 {
+		t.Errorf("both versions: errors %v and %v, versions %d and %d, Agree %v",
+			r.V3Err, r.V4Err, r.V3.Version, r.V4.Version, r.Agree)
+	}
+}
+
+func TestQueryPair(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	tests := []struct {
+		name      string
+		second    ntptest.Reply
+		divergent bool
+	}{
+		{"consistent", ntptest.Reply{Stratum: 2}, false},
+		{"slower path", ntptest.Reply{Stratum: 2, Delay: 60 * ms}, true},
+		{"other server", ntptest.Reply{Stratum: 2, Offset: 60 * ms}, true},
+	}
+	for _, tt := range tests {
+		s.SetReplies(ntptest.Reply{Stratum: 2}, tt.second)
+		r, err := QueryPair(s.Host, QueryOptions{Port: s.Port}, 20*ms)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if r.Divergent != tt.divergent {
+			t.Errorf("%s: Divergent = %v with delay diff %v and offset diff %v", tt.name, r.Divergent, r.DelayDiff, r.OffsetDiff)
+		}
+		if r.DelayDiff != r.Second.Delay-r.First.Delay || r.OffsetDiff != r.Second.Offset-r.First.Offset {
+			t.Errorf("%s: diffs %v and %v do not match the samples", tt.name, r.DelayDiff, r.OffsetDiff)
+		}
+	}
+	s.SetReplies(ntptest.Reply{Stratum: 2}, ntptest.Reply{Stratum: 16})
+	r, err := QueryPair(s.Host, QueryOptions{Port: s.Port}, 20*ms)
+	if err != ErrUnsynchronizedServer || r.First.Stratum != 2 {
+		t.Errorf("failed second query: err = %v, first stratum %d", err, r.First.Stratum)
+	}
+}
+
+func TestQueryInterfaces(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2})
+	locals := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2), net.IPv4(192, 0, 2, 1)}
+	stats, errs := QueryInterfaces(s.Host, locals, QueryOptions{Port: s.Port, Timeout: time.Second})
+	if len(stats) != 3 || len(errs) != 3 {
+		t.Fatalf("%d stats and %d errors, want 3", len(stats), len(errs))
+	}
+	if errs[1] != nil {
+		t.Skipf("cannot bind 127.0.0.2: %v", errs[1])
+	}
+	for i, ip := range locals[:2] {
+		if errs[i] != nil {
+			t.Errorf("from %v: %v", ip, errs[i])
+			continue
+		}
+		if a, ok := stats[i].LocalAddr.(*net.UDPAddr); !ok || !a.IP.Equal(ip) {
+			t.Errorf("query from %v sent from %v", ip, stats[i].LocalAddr)
+		}
+	}
+	// An address not on this host is reported for its own entry only.
+	var te *TransportError
+	if !errors.As(errs[2], &te) || te.Phase != "dial" {
+		t.Errorf("from 192.0.2.1: err = %v, want a dial error", errs[2])
+	}
+}
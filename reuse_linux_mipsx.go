@@ -0,0 +1,7 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package ntp
+
+// soReusePort is SO_REUSEPORT, which package syscall does not define for
+// Linux.  MIPS numbers its socket options apart from other architectures.
+const soReusePort = 0x200
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package ntp
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reuseControl(network, address string, c syscall.RawConn) error {
+	return errors.New("port reuse not supported on this platform")
+}
@@ -0,0 +1,16 @@
+package ntp
+
+import "syscall"
+
+// reuseControl sets SO_REUSEADDR on a socket before it is bound, which on
+// Windows lets several sockets bind the same port.
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
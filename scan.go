@@ -0,0 +1,80 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// MaxScanHosts is the largest number of addresses ScanCIDR will probe.
+const MaxScanHosts = 4096
+
+// ErrScanTooLarge is returned by ScanCIDR for ranges holding more than
+// MaxScanHosts addresses.
+var ErrScanTooLarge = errors.New("address range too large to scan")
+
+// ScanCIDR queries every address in the range cidr, given in the form
+// "192.0.2.0/24" or "2001:db8::/120", and returns the responding servers
+// and the errors for those that did not respond, keyed by IP.  The
+// network and broadcast addresses of IPv4 ranges are included.
+func ScanCIDR(cidr string, opt QueryOptions) (map[string]NtpStats, map[string]error) {
+	return ScanCIDRContext(context.Background(), cidr, opt)
+}
+
+// ScanCIDRContext is like ScanCIDR but gives up when ctx is done; the
+// addresses not yet answered then fail with ctx.Err().
+func ScanCIDRContext(ctx context.Context, cidr string, opt QueryOptions) (map[string]NtpStats, map[string]error) {
+	stats := make(map[string]NtpStats)
+	errs := make(map[string]error)
+
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		errs[cidr] = err
+		return stats, errs
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 30 || 1<<uint(bits-ones) > MaxScanHosts {
+		errs[cidr] = ErrScanTooLarge
+		return stats, errs
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, opt.concurrency())
+	)
+	for ip = ip.Mask(ipnet.Mask); ipnet.Contains(ip); ip = nextIP(ip) {
+		host := ip.String()
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := QueryContext(ctx, host, opt)
+			<-sem
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[host] = err
+			} else {
+				stats[host] = s
+			}
+		}()
+	}
+	wg.Wait()
+
+	return stats, errs
+}
+
+// nextIP returns the address following ip, wrapping to zero.
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
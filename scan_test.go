@@ -0,0 +1,59 @@
+package ntp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestScanCIDR(t *testing.T) {
+	// Servers at .1 and .2 of 127.0.0.0/30; .0 and .3 do not answer.
+	_, port := newPool(t, ntptest.Reply{Stratum: 1}, ntptest.Reply{Stratum: 2})
+	stats, errs := ScanCIDR("127.0.0.0/30", QueryOptions{Port: port, Timeout: 200 * time.Millisecond})
+
+	for host, stratum := range map[string]byte{"127.0.0.1": 1, "127.0.0.2": 2} {
+		if s, ok := stats[host]; !ok || s.Stratum != stratum {
+			t.Errorf("%s: stratum %d, err %v; want stratum %d", host, s.Stratum, errs[host], stratum)
+		}
+	}
+	for _, host := range []string{"127.0.0.0", "127.0.0.3"} {
+		if errs[host] == nil {
+			t.Errorf("%s: no error for an address without a server", host)
+		}
+	}
+	if len(stats)+len(errs) != 4 {
+		t.Errorf("%d results for a /30, want 4", len(stats)+len(errs))
+	}
+}
+
+func TestScanCIDRLimits(t *testing.T) {
+	if _, errs := ScanCIDR("10.0.0.0/8", QueryOptions{}); !errors.Is(errs["10.0.0.0/8"], ErrScanTooLarge) {
+		t.Errorf("/8: errs = %v, want ErrScanTooLarge", errs)
+	}
+	if _, errs := ScanCIDR("2001:db8::/64", QueryOptions{}); !errors.Is(errs["2001:db8::/64"], ErrScanTooLarge) {
+		t.Errorf("IPv6 /64: errs = %v, want ErrScanTooLarge", errs)
+	}
+	if _, errs := ScanCIDR("not a range", QueryOptions{}); errs["not a range"] == nil {
+		t.Error("no error for an invalid range")
+	}
+}
+
+func TestNextIP(t *testing.T) {
+	tests := []struct{ ip, want string }{
+		{"192.0.2.1", "192.0.2.2"},
+		{"192.0.2.255", "192.0.3.0"},
+		{"2001:db8::ffff", "2001:db8::1:0"},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if got := nextIP(ip).String(); got != tt.want {
+			t.Errorf("nextIP(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,596 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNoResponses is returned by a Selector given no responses to choose
+// from.
+var ErrNoResponses = errors.New("no responses to select from")
+
+// A Selector chooses a single response among those obtained from several
+// servers.
+type Selector interface {
+	Select([]NtpStats) (NtpStats, error)
+}
+
+// SelectorFunc adapts an ordinary function to the Selector interface.
+type SelectorFunc func([]NtpStats) (NtpStats, error)
+
+// Select calls f(stats).
+func (f SelectorFunc) Select(stats []NtpStats) (NtpStats, error) {
+	return f(stats)
+}
+
+// MinDelay selects the response with the smallest round trip delay.
+var MinDelay Selector = SelectorFunc(func(stats []NtpStats) (NtpStats, error) {
+	return minBy(stats, func(s NtpStats) time.Duration { return s.Delay })
+})
+
+// MinRootDistance selects the response with the smallest root distance.
+var MinRootDistance Selector = SelectorFunc(func(stats []NtpStats) (NtpStats, error) {
+	return minBy(stats, NtpStats.RootDistance)
+})
+
+// MedianOffset selects the response with the median offset.  With an even
+// number of responses the lower of the two middle offsets is chosen.
+var MedianOffset Selector = SelectorFunc(func(stats []NtpStats) (NtpStats, error) {
+	if len(stats) == 0 {
+		return NtpStats{}, ErrNoResponses
+	}
+	sorted := append([]NtpStats(nil), stats...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	return sorted[(len(sorted)-1)/2], nil
+})
+
+// WeightedOffset returns the response with the smallest root distance,
+// with its offset replaced by the mean of all offsets weighted by the
+// inverse of their root distance.
+var WeightedOffset Selector = SelectorFunc(func(stats []NtpStats) (NtpStats, error) {
+	best, err := MinRootDistance.Select(stats)
+	if err != nil {
+		return best, err
+	}
+
+	var sum, wsum float64
+	for _, s := range stats {
+		d := s.RootDistance().Seconds()
+		if d <= 0 {
+			d = 1e-9
+		}
+		sum += s.Offset.Seconds() / d
+		wsum += 1 / d
+	}
+	best.Offset = time.Duration(sum / wsum * 1e9)
+	return best, nil
+})
+
+func minBy(stats []NtpStats, key func(NtpStats) time.Duration) (NtpStats, error) {
+	if len(stats) == 0 {
+		return NtpStats{}, ErrNoResponses
+	}
+	best := stats[0]
+	for _, s := range stats[1:] {
+		if key(s) < key(best) {
+			best = s
+		}
+	}
+	return best, nil
+}
+
+// SortByQuality sorts stats in place, best first by Score and then by
+// round trip delay.  Invalid responses, those with stratum 0 or 16 and
+// above such as the zero NtpStats of a failed query, are placed last.
+func SortByQuality(stats []NtpStats) {
+	valid := func(s NtpStats) bool { return s.Stratum > 0 && s.Stratum < 16 }
+	sort.SliceStable(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if valid(a) != valid(b) {
+			return valid(a)
+		}
+		if a.Score() != b.Score() {
+			return a.Score() < b.Score()
+		}
+		return a.Delay < b.Delay
+	})
+}
+
+// Consistent reports whether the offset confidence intervals of a and b
+// overlap, that is whether the two servers can both be correct.
+func Consistent(a, b NtpStats) bool {
+	alo, ahi := a.Interval()
+	blo, bhi := b.Interval()
+	return alo <= bhi && blo <= ahi
+}
+
+// QueryMany queries each of hosts concurrently, with at most
+// opt.Concurrency queries outstanding.  The returned stats and errors are
+// in the same order as hosts; for each host exactly one of them is
+// meaningful.
+func QueryMany(hosts []string, opt QueryOptions) ([]NtpStats, []error) {
+	return QueryManyContext(context.Background(), hosts, opt)
+}
+
+// QueryManyContext is like QueryMany but gives up when ctx is done; the
+// queries not yet finished then fail with ctx.Err().
+func QueryManyContext(ctx context.Context, hosts []string, opt QueryOptions) ([]NtpStats, []error) {
+	stats := make([]NtpStats, len(hosts))
+	errs := make([]error, len(hosts))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opt.concurrency())
+	for i, host := range hosts {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			stats[i], errs[i] = QueryContext(ctx, host, opt)
+			<-sem
+		}(i, host)
+	}
+	wg.Wait()
+
+	return stats, errs
+}
+
+// QuerySelect queries each of hosts and returns the response chosen by sel
+// among those that succeeded.
+func QuerySelect(hosts []string, opt QueryOptions, sel Selector) (NtpStats, error) {
+	return QuerySelectContext(context.Background(), hosts, opt, sel)
+}
+
+// QuerySelectContext is like QuerySelect but gives up, returning
+// ctx.Err(), when ctx is done.
+func QuerySelectContext(ctx context.Context, hosts []string, opt QueryOptions, sel Selector) (NtpStats, error) {
+	stats, errs := QueryManyContext(ctx, hosts, opt)
+	if err := ctx.Err(); err != nil {
+		return NtpStats{}, err
+	}
+
+	var ok []NtpStats
+	for i, err := range errs {
+		if err == nil {
+			ok = append(ok, stats[i])
+		}
+	}
+	return sel.Select(ok)
+}
+
+// ServerDelta queries hostA and hostB concurrently and returns how far the
+// clock of hostA is ahead of that of hostB.  Since both offsets are
+// measured against the same local clock, its error largely cancels out.
+func ServerDelta(hostA, hostB string, opt QueryOptions) (time.Duration, error) {
+	return ServerDeltaContext(context.Background(), hostA, hostB, opt)
+}
+
+// ServerDeltaContext is like ServerDelta but gives up, returning
+// ctx.Err(), when ctx is done.
+func ServerDeltaContext(ctx context.Context, hostA, hostB string, opt QueryOptions) (time.Duration, error) {
+	stats, errs := QueryManyContext(ctx, []string{hostA, hostB}, opt)
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return stats[0].Offset - stats[1].Offset, nil
+}
+
+// PoolTime queries hosts and returns the current time corrected by their
+// combined offset, along with a bound on its error.  The offset is the
+// WeightedOffset of the servers that answered.  If every server is
+// correct the true offset lies within each one's confidence interval, so
+// the bound is the smallest distance from the combined offset to the far
+// edge of any of them.
+func PoolTime(hosts []string, opt QueryOptions) (time.Time, time.Duration, error) {
+	return PoolTimeContext(context.Background(), hosts, opt)
+}
+
+// PoolTimeContext is like PoolTime but gives up, returning ctx.Err(),
+// when ctx is done.
+func PoolTimeContext(ctx context.Context, hosts []string, opt QueryOptions) (time.Time, time.Duration, error) {
+	stats, errs := QueryManyContext(ctx, hosts, opt)
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, 0, err
+	}
+
+	var ok []NtpStats
+	for i, err := range errs {
+		if err == nil {
+			ok = append(ok, stats[i])
+		}
+	}
+	offset, bound, err := combine(ok)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return time.Now().Add(offset), bound, nil
+}
+
+// combine returns the WeightedOffset of stats and the bound on its error
+// described for PoolTime.
+func combine(stats []NtpStats) (time.Duration, time.Duration, error) {
+	best, err := WeightedOffset.Select(stats)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bound := time.Duration(math.MaxInt64)
+	for _, s := range stats {
+		if b := abs(best.Offset-s.Offset) + s.RootDistance(); b < bound {
+			bound = b
+		}
+	}
+	return best.Offset, bound, nil
+}
+
+// intersection finds the smallest interval containing points of the
+// confidence intervals of a majority of stats, using the intersection
+// algorithm of RFC 5905 section 11.2.1, allowing as few falsetickers as
+// possible.  ok is false if no majority agrees.
+func intersection(stats []NtpStats) (lo, hi time.Duration, ok bool) {
+	type edge struct {
+		value time.Duration
+		kind  int // -1 low end, 0 offset, +1 high end
+	}
+	n := len(stats)
+	edges := make([]edge, 0, 3*n)
+	for _, s := range stats {
+		l, h := s.Interval()
+		edges = append(edges, edge{l, -1}, edge{s.Offset, 0}, edge{h, +1})
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].value != edges[j].value {
+			return edges[i].value < edges[j].value
+		}
+		return edges[i].kind < edges[j].kind
+	})
+
+	for allow := 0; 2*allow < n; allow++ {
+		found, chime := 0, 0
+		for _, e := range edges {
+			chime -= e.kind
+			if chime >= n-allow {
+				lo = e.value
+				break
+			}
+			if e.kind == 0 {
+				found++
+			}
+		}
+		chime = 0
+		for i := len(edges) - 1; i >= 0; i-- {
+			chime += edges[i].kind
+			if chime >= n-allow {
+				hi = edges[i].value
+				break
+			}
+			if edges[i].kind == 0 {
+				found++
+			}
+		}
+		if found > allow {
+			continue
+		}
+		if hi > lo {
+			return lo, hi, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Classify labels each of stats as a truechimer, true, or a falseticker,
+// false.  Truechimers are the servers whose confidence intervals overlap
+// the interval on which a majority agrees; if there is no majority all
+// are falsetickers.
+func Classify(stats []NtpStats) []bool {
+	labels := make([]bool, len(stats))
+	lo, hi, ok := intersection(stats)
+	if !ok {
+		return labels
+	}
+	for i, s := range stats {
+		l, h := s.Interval()
+		labels[i] = l <= hi && lo <= h
+	}
+	return labels
+}
+
+// Truechimers returns the stats that Classify labels truechimers.
+func Truechimers(stats []NtpStats) []NtpStats {
+	var t []NtpStats
+	for i, ok := range Classify(stats) {
+		if ok {
+			t = append(t, stats[i])
+		}
+	}
+	return t
+}
+
+// ErrNoMajority is returned by PoolTimeTrace when no majority of the
+// servers that answered agree on the time.
+var ErrNoMajority = errors.New("no majority of servers agree")
+
+// A Verdict tells whether a server took part in a selection and, if not,
+// why.
+type Verdict int
+
+const (
+	Selected    Verdict = iota // a truechimer, included in the combined offset
+	Failed                     // the query failed
+	Falseticker                // its interval misses the majority's intersection
+	NoMajority                 // no majority of the servers agree
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Selected:
+		return "selected"
+	case Failed:
+		return "query failed"
+	case Falseticker:
+		return "falseticker"
+	case NoMajority:
+		return "no majority"
+	}
+	return "Verdict(" + strconv.Itoa(int(v)) + ")"
+}
+
+// A TraceEntry records how one server fared in a selection.
+type TraceEntry struct {
+	Host  string
+	Stats NtpStats
+	Err   error // the query error, for Failed servers
+
+	// Lo and Hi bound the server's confidence interval, from its
+	// Interval.
+	Lo, Hi time.Duration
+
+	Verdict Verdict
+}
+
+// A SelectionTrace records how PoolTimeTrace combined its servers.
+type SelectionTrace struct {
+	// Lo and Hi bound the interval a majority of the servers agree on,
+	// found by the intersection algorithm; Majority is false, and they
+	// are zero, if there is none.
+	Lo, Hi   time.Duration
+	Majority bool
+
+	// Servers holds an entry per host, in the order given.
+	Servers []TraceEntry
+}
+
+// PoolTimeTrace is like PoolTime but combines only the truechimers, as
+// labeled by Classify, and also returns a trace of the selection
+// explaining why each server was or was not included.  The trace is
+// returned even when the error is not nil.
+func PoolTimeTrace(hosts []string, opt QueryOptions) (time.Time, time.Duration, *SelectionTrace, error) {
+	return PoolTimeTraceContext(context.Background(), hosts, opt)
+}
+
+// PoolTimeTraceContext is like PoolTimeTrace but gives up, returning
+// ctx.Err() and no trace, when ctx is done.
+func PoolTimeTraceContext(ctx context.Context, hosts []string, opt QueryOptions) (time.Time, time.Duration, *SelectionTrace, error) {
+	stats, errs := QueryManyContext(ctx, hosts, opt)
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, 0, nil, err
+	}
+
+	t, chimers := traceSelection(hosts, stats, errs)
+	offset, bound, err := combine(chimers)
+	if err != nil {
+		for _, e := range t.Servers {
+			if e.Verdict == NoMajority {
+				err = ErrNoMajority
+			}
+		}
+		return time.Time{}, 0, t, err
+	}
+	return time.Now().Add(offset), bound, t, nil
+}
+
+// traceSelection classifies the results of querying hosts, returning the
+// trace and the stats of the truechimers.
+func traceSelection(hosts []string, stats []NtpStats, errs []error) (*SelectionTrace, []NtpStats) {
+	t := &SelectionTrace{Servers: make([]TraceEntry, len(hosts))}
+	var ok []NtpStats
+	var idx []int
+	for i, host := range hosts {
+		e := &t.Servers[i]
+		e.Host, e.Err = host, errs[i]
+		if errs[i] != nil {
+			e.Verdict = Failed
+			continue
+		}
+		e.Stats = stats[i]
+		e.Lo, e.Hi = stats[i].Interval()
+		ok = append(ok, stats[i])
+		idx = append(idx, i)
+	}
+
+	t.Lo, t.Hi, t.Majority = intersection(ok)
+	var chimers []NtpStats
+	for _, i := range idx {
+		e := &t.Servers[i]
+		switch {
+		case !t.Majority:
+			e.Verdict = NoMajority
+		case e.Lo <= t.Hi && t.Lo <= e.Hi:
+			e.Verdict = Selected
+			chimers = append(chimers, e.Stats)
+		default:
+			e.Verdict = Falseticker
+		}
+	}
+	return t, chimers
+}
+
+// A Reason tells why a server was rejected from a selection.
+type Reason int
+
+const (
+	ReasonTimeout        Reason = iota // no reply before the timeout
+	ReasonUnreachable                  // the host or port is unreachable
+	ReasonKissOfDeath                  // a kiss-o'-death reply, such as RATE
+	ReasonUnsynchronized               // stratum 16 or a leap alarm
+	ReasonStratum                      // stratum out of range
+	ReasonInvalid                      // the reply failed another check
+	ReasonError                        // any other query error
+	ReasonFalseticker                  // its interval misses the majority's
+	ReasonNoMajority                   // no majority of the servers agree
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonTimeout:
+		return "timeout"
+	case ReasonUnreachable:
+		return "unreachable"
+	case ReasonKissOfDeath:
+		return "kiss-o'-death"
+	case ReasonUnsynchronized:
+		return "unsynchronized"
+	case ReasonStratum:
+		return "stratum out of range"
+	case ReasonInvalid:
+		return "invalid reply"
+	case ReasonError:
+		return "query failed"
+	case ReasonFalseticker:
+		return "falseticker"
+	case ReasonNoMajority:
+		return "no majority"
+	}
+	return "Reason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// A Rejection records a server that BestTime queried but did not use.
+type Rejection struct {
+	Host   string
+	Reason Reason
+	Code   string // the kiss code, for ReasonKissOfDeath
+	Err    error  // the query error, nil for falsetickers and no majority
+}
+
+func (r Rejection) String() string {
+	if r.Code != "" {
+		return r.Host + ": " + r.Reason.String() + " " + r.Code
+	}
+	return r.Host + ": " + r.Reason.String()
+}
+
+// invalidReply are the errors for replies that failed a sanity check,
+// reported as ReasonInvalid.
+var invalidReply = []error{
+	ErrInvalidMode, ErrRootDistance, ErrTransmitBeforeReceive,
+	ErrTransmitBeforeRef, ErrVersionMismatch, ErrUnexpectedRefID,
+	ErrSpoofedReply, ErrPrecisionTooCoarse, ErrFutureTimestamp,
+	ErrBogusPacket, ErrAuthFailed,
+}
+
+// BestTime is like PoolTimeTrace but returns, instead of the trace, the
+// servers that were queried but did not contribute to the time, each
+// with the reason.  The rejections are returned even when the error is
+// not nil.
+func BestTime(hosts []string, opt QueryOptions) (time.Time, []Rejection, error) {
+	return BestTimeContext(context.Background(), hosts, opt)
+}
+
+// BestTimeContext is like BestTime but gives up, returning ctx.Err() and
+// no rejections, when ctx is done.
+func BestTimeContext(ctx context.Context, hosts []string, opt QueryOptions) (time.Time, []Rejection, error) {
+	now, _, t, err := PoolTimeTraceContext(ctx, hosts, opt)
+	if t == nil {
+		return time.Time{}, nil, err
+	}
+	var rejected []Rejection
+	for _, e := range t.Servers {
+		if e.Verdict != Selected {
+			rejected = append(rejected, reject(e))
+		}
+	}
+	return now, rejected, err
+}
+
+// reject gives the rejection of the server of e, which was not selected.
+func reject(e TraceEntry) Rejection {
+	r := Rejection{Host: e.Host, Err: e.Err}
+	var kod *KissOfDeathError
+	switch {
+	case e.Verdict == Falseticker:
+		r.Reason = ReasonFalseticker
+	case e.Verdict == NoMajority:
+		r.Reason = ReasonNoMajority
+	case errors.As(e.Err, &kod):
+		r.Reason, r.Code = ReasonKissOfDeath, kod.Code
+	case errors.Is(e.Err, ErrUnsynchronizedServer) || errors.Is(e.Err, ErrServerNotSynchronized):
+		r.Reason = ReasonUnsynchronized
+	case errors.Is(e.Err, ErrInvalidStratum):
+		r.Reason = ReasonStratum
+	case isTimeout(e.Err):
+		r.Reason = ReasonTimeout
+	case errors.Is(e.Err, ErrServerUnreachable):
+		r.Reason = ReasonUnreachable
+	default:
+		r.Reason = ReasonError
+		for _, v := range invalidReply {
+			if errors.Is(e.Err, v) {
+				r.Reason = ReasonInvalid
+			}
+		}
+	}
+	return r
+}
+
+// An Intersection is an interval of offsets consistent with the
+// confidence intervals of several servers.
+type Intersection struct {
+	Lo, Hi time.Duration
+	Offset time.Duration // midpoint of the interval
+	Count  int           // number of servers consistent with it
+}
+
+// Marzullo applies Marzullo's algorithm to the confidence intervals of
+// stats, returning the smallest interval consistent with as many of them
+// as possible.  Its midpoint is the best estimate of the offset.
+func Marzullo(stats []NtpStats) (Intersection, error) {
+	if len(stats) == 0 {
+		return Intersection{}, ErrNoResponses
+	}
+
+	type edge struct {
+		value time.Duration
+		kind  int // +1 start, -1 end
+	}
+	edges := make([]edge, 0, 2*len(stats))
+	for _, s := range stats {
+		lo, hi := s.Interval()
+		edges = append(edges, edge{lo, +1}, edge{hi, -1})
+	}
+	// Starts sort before ends at the same value so that touching
+	// intervals count as overlapping.
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].value != edges[j].value {
+			return edges[i].value < edges[j].value
+		}
+		return edges[i].kind > edges[j].kind
+	})
+
+	var best Intersection
+	count := 0
+	for i, e := range edges {
+		count += e.kind
+		if count > best.Count {
+			best.Count = count
+			best.Lo, best.Hi = e.value, edges[i+1].value
+		}
+	}
+	best.Offset = best.Lo + (best.Hi-best.Lo)/2
+	return best, nil
+}
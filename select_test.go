@@ -0,0 +1,423 @@
+package ntp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+const ms = time.Millisecond
+
+func TestSelectors(t *testing.T) {
+	// The reference IDs tell the samples apart.
+	stats := []NtpStats{
+		{ReferenceID: 1, Offset: 5 * ms, Delay: 40 * ms, RootDispersion: 1 * ms},
+		{ReferenceID: 2, Offset: -2 * ms, Delay: 10 * ms, RootDispersion: 30 * ms},
+		{ReferenceID: 3, Offset: 1 * ms, Delay: 20 * ms, RootDispersion: 2 * ms},
+		{ReferenceID: 4, Offset: 9 * ms, Delay: 30 * ms, RootDispersion: 5 * ms},
+	}
+	tests := []struct {
+		name string
+		sel  Selector
+		want uint32
+	}{
+		{"MinDelay", MinDelay, 2},
+		{"MinRootDistance", MinRootDistance, 3},
+		{"MedianOffset", MedianOffset, 3},
+		{"WeightedOffset", WeightedOffset, 3},
+	}
+	for _, tt := range tests {
+		got, err := tt.sel.Select(stats)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.ReferenceID != tt.want {
+			t.Errorf("%s selected %d, want %d", tt.name, got.ReferenceID, tt.want)
+		}
+		if _, err := tt.sel.Select(nil); !errors.Is(err, ErrNoResponses) {
+			t.Errorf("%s of no responses: err = %v, want ErrNoResponses", tt.name, err)
+		}
+	}
+}
+
+func TestWeightedOffset(t *testing.T) {
+	// Root distances of 10ms and 30ms weight the offsets 3:1.
+	stats := []NtpStats{
+		{Offset: 0, RootDispersion: 10 * ms},
+		{Offset: 40 * ms, RootDispersion: 30 * ms},
+	}
+	got, err := WeightedOffset.Select(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := got.Offset - 10*ms; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("Offset = %v, want 10ms", got.Offset)
+	}
+}
+
+func TestQuerySelect(t *testing.T) {
+	hosts, port := newPool(t,
+		ntptest.Reply{Stratum: 3, Offset: 20 * ms},
+		ntptest.Reply{Stratum: 2, Offset: 10 * ms},
+		ntptest.Reply{Stratum: 4},
+	)
+	best, err := QuerySelect(hosts, QueryOptions{Port: port}, SelectorFunc(func(stats []NtpStats) (NtpStats, error) {
+		if len(stats) != 3 {
+			t.Errorf("selector given %d responses, want 3", len(stats))
+		}
+		SortByQuality(stats)
+		return stats[0], nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Stratum != 2 {
+		t.Errorf("selected stratum %d, want 2", best.Stratum)
+	}
+}
+
+func TestConsistent(t *testing.T) {
+	// Root distances of 5ms give intervals of offset ± 5ms.
+	at := func(offset time.Duration) NtpStats {
+		return NtpStats{Offset: offset, RootDispersion: 5 * ms}
+	}
+	tests := []struct {
+		a, b time.Duration
+		want bool
+	}{
+		{0, 0, true},
+		{0, 8 * ms, true},   // [-5,5] and [3,13] overlap
+		{0, 10 * ms, true},  // touching at 5ms
+		{0, 11 * ms, false}, // disjoint
+		{-20 * ms, 20 * ms, false},
+	}
+	for _, tt := range tests {
+		if got := Consistent(at(tt.a), at(tt.b)); got != tt.want {
+			t.Errorf("Consistent(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := Consistent(at(tt.b), at(tt.a)); got != tt.want {
+			t.Errorf("Consistent(%v, %v) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestQueryManyConcurrency(t *testing.T) {
+	// Each reply is held for 50ms, so six queries two at a time take at
+	// least three rounds.
+	s := newServer(t, ntptest.Reply{Stratum: 2, Delay: 50 * ms})
+	hosts := make([]string, 6)
+	for i := range hosts {
+		hosts[i] = s.Host
+	}
+
+	start := time.Now()
+	_, errs := QueryMany(hosts, QueryOptions{Port: s.Port, Concurrency: 2})
+	elapsed := time.Since(start)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if elapsed < 150*ms {
+		t.Errorf("6 queries at concurrency 2 took %v, want at least 150ms", elapsed)
+	}
+}
+
+func TestServerDelta(t *testing.T) {
+	hosts, port := newPool(t,
+		ntptest.Reply{Stratum: 2, Offset: 100 * ms},
+		ntptest.Reply{Stratum: 2, Offset: -50 * ms},
+	)
+	opt := QueryOptions{Port: port, Timeout: time.Second}
+
+	d, err := ServerDelta(hosts[0], hosts[1], opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d < 145*ms || d > 155*ms {
+		t.Errorf("ServerDelta() = %v, want about 150ms", d)
+	}
+
+	// Nothing listens at the third address.
+	if _, err := ServerDelta(hosts[0], "127.0.0.3", opt); err == nil {
+		t.Error("no error with one server down")
+	}
+}
+
+func TestPoolTime(t *testing.T) {
+	hosts, port := newPool(t,
+		ntptest.Reply{Stratum: 2, Offset: time.Hour - 2*ms, RootDispersion: 10 * ms},
+		ntptest.Reply{Stratum: 2, Offset: time.Hour, RootDispersion: 20 * ms},
+		ntptest.Reply{Stratum: 3, Offset: time.Hour + 2*ms, RootDispersion: 30 * ms},
+	)
+	// The fourth member is down.
+	hosts = append(hosts, "127.0.0.4")
+	opt := QueryOptions{Port: port, Timeout: time.Second}
+
+	before := time.Now()
+	now, bound, err := PoolTime(hosts, opt)
+	after := time.Now()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now.Before(before.Add(time.Hour-5*ms)) || now.After(after.Add(time.Hour+5*ms)) {
+		t.Errorf("PoolTime() = %v, want about an hour after %v", now, before)
+	}
+	// The tightest interval is the first server's, 10ms and half the
+	// delay either side of an offset within a few milliseconds.
+	if bound < 10*ms || bound > 15*ms {
+		t.Errorf("bound = %v, want between 10ms and 15ms", bound)
+	}
+
+	if _, _, err := PoolTime(hosts[3:], opt); err == nil {
+		t.Error("no error with every server down")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	// Four servers agree within a few milliseconds; the fifth is half a
+	// second out.  Each interval is the offset ± 10ms.
+	at := func(offset time.Duration) NtpStats {
+		return NtpStats{Offset: offset, RootDispersion: 10 * ms}
+	}
+	stats := []NtpStats{at(1 * ms), at(-2 * ms), at(500 * ms), at(3 * ms), at(0)}
+
+	labels := Classify(stats)
+	want := []bool{true, true, false, true, true}
+	for i := range want {
+		if labels[i] != want[i] {
+			t.Errorf("server %d (offset %v): truechimer = %v, want %v", i, stats[i].Offset, labels[i], want[i])
+		}
+	}
+	if tc := Truechimers(stats); len(tc) != 4 {
+		t.Errorf("Truechimers() returned %d servers, want 4", len(tc))
+	}
+	lo, hi, ok := intersection(stats)
+	if !ok || lo < -10*ms || hi > 12*ms || lo >= hi {
+		t.Errorf("intersection() = %v, %v, %v, want within the agreeing intervals", lo, hi, ok)
+	}
+
+	// Two pairs far apart leave no majority.
+	split := []NtpStats{at(0), at(1 * ms), at(time.Second), at(time.Second + ms)}
+	for i, ok := range Classify(split) {
+		if ok {
+			t.Errorf("split server %d labelled a truechimer", i)
+		}
+	}
+}
+
+func TestMarzullo(t *testing.T) {
+	// iv returns stats whose confidence interval is [lo, hi] milliseconds.
+	iv := func(lo, hi time.Duration) NtpStats {
+		return NtpStats{Offset: (lo + hi) * ms / 2, RootDispersion: (hi - lo) * ms / 2}
+	}
+	tests := []struct {
+		name  string
+		stats []NtpStats
+		want  Intersection
+	}{
+		{"all overlap", []NtpStats{iv(8, 12), iv(11, 13), iv(10, 12)}, Intersection{11 * ms, 12 * ms, 11500 * time.Microsecond, 3}},
+		{"first of two pairs", []NtpStats{iv(8, 9), iv(8, 12), iv(10, 12)}, Intersection{8 * ms, 9 * ms, 8500 * time.Microsecond, 2}},
+		{"outlier", []NtpStats{iv(-2, 2), iv(0, 4), iv(100, 104), iv(1, 3)}, Intersection{1 * ms, 2 * ms, 1500 * time.Microsecond, 3}},
+		{"touching", []NtpStats{iv(0, 2), iv(2, 4)}, Intersection{2 * ms, 2 * ms, 2 * ms, 2}},
+		{"single", []NtpStats{iv(-6, -2)}, Intersection{-6 * ms, -2 * ms, -4 * ms, 1}},
+	}
+	for _, tt := range tests {
+		got, err := Marzullo(tt.stats)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Marzullo() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := Marzullo(nil); !errors.Is(err, ErrNoResponses) {
+		t.Errorf("no stats: err = %v, want ErrNoResponses", err)
+	}
+}
+
+func TestSortByQuality(t *testing.T) {
+	// The valid responses are tagged with their rank in Poll.  Those ranked
+	// 2 and 3 have the same root distance and are ordered by delay.
+	stats := []NtpStats{
+		{}, // a failed query
+		{Poll: 3, Stratum: 1, Delay: 4 * ms, RootDelay: 2 * ms},
+		{Stratum: 16, Delay: ms},
+		{Poll: 4, Stratum: 2, Delay: ms},
+		{Poll: 1, Stratum: 1, Delay: 2 * ms, RootDelay: 2 * ms},
+		{Poll: 2, Stratum: 1, Delay: 2 * ms, RootDispersion: 2 * ms},
+		{Stratum: 0, Delay: ms}, // a kiss of death
+	}
+	SortByQuality(stats)
+	var got []time.Duration
+	for _, s := range stats {
+		got = append(got, s.Poll)
+	}
+	for i, s := range stats {
+		if want := time.Duration(i + 1); i < 4 && s.Poll != want || i >= 4 && s.Poll != 0 {
+			t.Fatalf("sorted as %v, want 1 to 4 then the invalid responses", got)
+		}
+	}
+}
+
+func TestTraceSelection(t *testing.T) {
+	at := func(offset time.Duration) NtpStats {
+		return NtpStats{Offset: offset, RootDispersion: 10 * ms}
+	}
+	hosts := []string{"a", "b", "c", "d", "e"}
+	failed := errors.New("query failed")
+	stats := []NtpStats{at(1 * ms), {}, at(500 * ms), at(3 * ms), at(0)}
+	errs := []error{nil, failed, nil, nil, nil}
+
+	trace, chimers := traceSelection(hosts, stats, errs)
+	if !trace.Majority || trace.Lo != -7*ms || trace.Hi != 10*ms {
+		t.Errorf("trace interval [%v, %v], majority %v, want [-7ms, 10ms] agreed by a majority", trace.Lo, trace.Hi, trace.Majority)
+	}
+	want := []struct {
+		lo, hi  time.Duration
+		err     error
+		verdict Verdict
+	}{
+		{-9 * ms, 11 * ms, nil, Selected},
+		{0, 0, failed, Failed},
+		{490 * ms, 510 * ms, nil, Falseticker},
+		{-7 * ms, 13 * ms, nil, Selected},
+		{-10 * ms, 10 * ms, nil, Selected},
+	}
+	for i, e := range trace.Servers {
+		w := want[i]
+		if e.Host != hosts[i] || e.Lo != w.lo || e.Hi != w.hi || e.Err != w.err || e.Verdict != w.verdict {
+			t.Errorf("entry %d: %s [%v, %v] %v %v, want %s [%v, %v] %v %v", i, e.Host, e.Lo, e.Hi, e.Err, e.Verdict, hosts[i], w.lo, w.hi, w.err, w.verdict)
+		}
+	}
+	if len(chimers) != 3 {
+		t.Errorf("%d truechimers, want 3", len(chimers))
+	}
+
+	// Two pairs far apart leave no majority.
+	split := []NtpStats{at(0), at(1 * ms), at(time.Second), at(time.Second + ms)}
+	trace, chimers = traceSelection(hosts[:4], split, make([]error, 4))
+	if trace.Majority || len(chimers) != 0 {
+		t.Errorf("split pool: majority %v with %d truechimers", trace.Majority, len(chimers))
+	}
+	for i, e := range trace.Servers {
+		if e.Verdict != NoMajority {
+			t.Errorf("split pool entry %d: verdict %v, want %v", i, e.Verdict, NoMajority)
+		}
+	}
+
+	for v, s := range map[Verdict]string{Selected: "selected", Failed: "query failed", Falseticker: "falseticker", NoMajority: "no majority", 7: "Verdict(7)"} {
+		if v.String() != s {
+			t.Errorf("Verdict(%d).String() = %q, want %q", int(v), v.String(), s)
+		}
+	}
+}
+
+func TestPoolTimeTrace(t *testing.T) {
+	hosts, port := newPool(t,
+		ntptest.Reply{Stratum: 2, Offset: time.Hour, RootDispersion: 10 * ms},
+		ntptest.Reply{Stratum: 2, Offset: time.Hour + 2*ms, RootDispersion: 10 * ms},
+		ntptest.Reply{Stratum: 2, Offset: time.Hour + time.Second, RootDispersion: 10 * ms},
+	)
+	// The fourth member is down.
+	hosts = append(hosts, "127.0.0.4")
+	opt := QueryOptions{Port: port, Timeout: 100 * ms}
+
+	before := time.Now()
+	now, _, trace, err := PoolTimeTrace(hosts, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := now.Sub(before); d < time.Hour-5*ms || d > time.Hour+200*ms {
+		t.Errorf("PoolTimeTrace() = %v ahead, want about an hour, ignoring the falseticker", d)
+	}
+	for i, want := range []Verdict{Selected, Selected, Falseticker, Failed} {
+		if v := trace.Servers[i].Verdict; v != want {
+			t.Errorf("%s: verdict %v, want %v", hosts[i], v, want)
+		}
+	}
+
+	// Without a majority the trace still explains why.
+	_, _, trace, err = PoolTimeTrace([]string{hosts[0], hosts[2]}, opt)
+	if err != ErrNoMajority || trace == nil || trace.Servers[0].Verdict != NoMajority {
+		t.Errorf("no majority: err = %v, trace %+v", err, trace)
+	}
+}
+
+func TestBestTime(t *testing.T) {
+	good := ntptest.Reply{Stratum: 2, Offset: time.Hour, RootDispersion: 10 * ms}
+	hosts, port := newPool(t,
+		good, good, good,
+		ntptest.Reply{Stratum: 2, Offset: time.Hour + time.Second, RootDispersion: 10 * ms},
+		ntptest.Reply{Stratum: 0, ReferenceID: "RATE"},
+		ntptest.Reply{Stratum: 16},
+		ntptest.Reply{Stratum: 17},
+	)
+	// The eighth member does not answer at all.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 8), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	hosts = append(hosts, "127.0.0.8")
+
+	before := time.Now()
+	now, rejected, err := BestTime(hosts, QueryOptions{Port: port, Timeout: 100 * ms, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := now.Sub(before); d < time.Hour-5*ms || d > time.Hour+200*ms {
+		t.Errorf("BestTime() = %v ahead, want about an hour", d)
+	}
+	want := []Rejection{
+		{Host: hosts[3], Reason: ReasonFalseticker},
+		{Host: hosts[4], Reason: ReasonKissOfDeath, Code: "RATE"},
+		{Host: hosts[5], Reason: ReasonUnsynchronized},
+		{Host: hosts[6], Reason: ReasonStratum},
+		{Host: hosts[7], Reason: ReasonTimeout},
+	}
+	if len(rejected) != len(want) {
+		t.Fatalf("rejected %v, want %v", rejected, want)
+	}
+	for i, r := range rejected {
+		if r.Host != want[i].Host || r.Reason != want[i].Reason || r.Code != want[i].Code || (r.Err == nil) != (r.Reason == ReasonFalseticker) {
+			t.Errorf("rejection %d: %v (err %v), want %v", i, r, r.Err, want[i])
+		}
+	}
+	if s := rejected[1].String(); s != hosts[4]+": kiss-o'-death RATE" {
+		t.Errorf("kiss-o'-death rejection formatted as %q", s)
+	}
+}
+
+func TestReject(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason Reason
+	}{
+		{&TransportError{"read", os.ErrDeadlineExceeded}, ReasonTimeout},
+		{ErrServerNotSynchronized, ReasonUnsynchronized},
+		{fmt.Errorf("%w %q", ErrUnexpectedRefID, "GOES"), ReasonInvalid},
+		{ErrBogusPacket, ReasonInvalid},
+		{errors.New("something else"), ReasonError},
+	}
+	for _, tt := range tests {
+		r := reject(TraceEntry{Host: "h", Err: tt.err, Verdict: Failed})
+		if r.Reason != tt.reason || r.Err != tt.err {
+			t.Errorf("reject(%v) = %v, want %v", tt.err, r.Reason, tt.reason)
+		}
+	}
+	if r := reject(TraceEntry{Host: "h", Verdict: NoMajority}); r.Reason != ReasonNoMajority || r.String() != "h: no majority" {
+		t.Errorf("no majority rejected as %v", r)
+	}
+	if s := Reason(20).String(); s != "Reason(20)" {
+		t.Errorf("unknown reason formatted as %q", s)
+	}
+}
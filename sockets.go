@@ -0,0 +1,63 @@
+package ntp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSockets is the initial limit on the sockets the package keeps
+// open at once.
+const DefaultMaxSockets = 256
+
+var sockets = struct {
+	mu  sync.Mutex
+	sem chan struct{}
+}{sem: make(chan struct{}, DefaultMaxSockets)}
+
+// SetMaxSockets limits the number of UDP sockets the package's queries,
+// of every kind and from all goroutines, keep open at once to n, so that
+// large batches of queries cannot exhaust file descriptors.  A query
+// waits for a socket to be free, within its timeout.  If n is zero or
+// negative, there is no limit.  Sockets opened before the call count
+// against the limit they were opened under.  Sockets passed in by the
+// caller, as to QueryPacketConn, do not count.
+func SetMaxSockets(n int) {
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+	if n <= 0 {
+		sockets.sem = nil
+		return
+	}
+	sockets.sem = make(chan struct{}, n)
+}
+
+// acquireSocket waits until a socket may be opened, at most until
+// deadline or until ctx is done, and returns the function releasing it.
+func acquireSocket(ctx context.Context, deadline time.Time) (release func(), err error) {
+	sockets.mu.Lock()
+	sem := sockets.sem
+	sockets.mu.Unlock()
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return releaseOnce(sem), nil
+	default:
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	select {
+	case sem <- struct{}{}:
+		return releaseOnce(sem), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func releaseOnce(sem chan struct{}) func() {
+	var once sync.Once
+	return func() { once.Do(func() { <-sem }) }
+}
@@ -0,0 +1,103 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestMaxSockets(t *testing.T) {
+	defer SetMaxSockets(DefaultMaxSockets)
+	SetMaxSockets(2)
+	sem := sockets.sem
+
+	// Sample the sockets in use while several helpers query a slow
+	// server at once.
+	peak := 0
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if n := len(sem); n > peak {
+				peak = n
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond / 4):
+			}
+		}
+	}()
+
+	s := newServer(t, ntptest.Reply{Stratum: 2, Delay: 30 * ms})
+	opt := QueryOptions{Port: s.Port, Timeout: 2 * time.Second, Concurrency: 8}
+	hosts := []string{s.Host, s.Host, s.Host, s.Host}
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, e := QueryMany(hosts, opt)
+			mu.Lock()
+			errs = append(errs, e...)
+			mu.Unlock()
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := QueryWithOptions(s.Host, opt)
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(stop)
+	<-sampled
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("query waiting for a socket: %v", err)
+		}
+	}
+	if peak != 2 {
+		t.Errorf("at most %d sockets open at once, want the limit of 2", peak)
+	}
+	// Ten queries two at a time take five delays.
+	if elapsed < 5*30*ms {
+		t.Errorf("10 queries took %v, too fast for 2 at a time", elapsed)
+	}
+	if len(sem) != 0 {
+		t.Errorf("%d sockets still counted after the queries", len(sem))
+	}
+
+	// A query that cannot get a socket within its timeout fails to dial.
+	SetMaxSockets(1)
+	release, err := acquireSocket(context.Background(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = QueryWithOptions(s.Host, QueryOptions{Port: s.Port, Timeout: 50 * ms})
+	var te *TransportError
+	if !errors.As(err, &te) || te.Phase != "dial" || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("no socket free: err = %v, want a dial error from the deadline", err)
+	}
+	release()
+	release() // releasing twice frees one socket only
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port}); err != nil {
+		t.Errorf("socket free again: %v", err)
+	}
+
+	SetMaxSockets(0)
+	if sockets.sem != nil {
+		t.Error("SetMaxSockets(0) left a limit in place")
+	}
+}
@@ -0,0 +1,45 @@
+package ntp
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrLeapTableRange is returned when a leap second table does not cover
+// the time it is consulted for.
+var ErrLeapTableRange = errors.New("time not covered by leap second table")
+
+// A LeapSecond records the difference TAI-UTC, in whole seconds, in force
+// from a UTC instant on.
+type LeapSecond struct {
+	Since     time.Time
+	TAIOffset int
+}
+
+// A LeapTable lists the values of TAI-UTC in order of time.  The package
+// has no built-in table: it must be supplied by the caller, for instance
+// from the IERS leap-seconds.list file, and kept up to date, as leap
+// seconds are announced only months ahead.  Since 1 January 2017 TAI-UTC
+// has been 37 seconds.
+type LeapTable []LeapSecond
+
+// At returns TAI-UTC at the UTC time t, failing with ErrLeapTableRange if
+// t precedes the first entry of the table.
+func (lt LeapTable) At(t time.Time) (time.Duration, error) {
+	for i := len(lt) - 1; i >= 0; i-- {
+		if !t.Before(lt[i].Since) {
+			return time.Duration(lt[i].TAIOffset) * time.Second, nil
+		}
+	}
+	return 0, ErrLeapTableRange
+}
+
+// TAI returns the server's transmit time converted to TAI by adding
+// TAI-UTC at that time, taken from lt.
+func (s NtpStats) TAI(lt LeapTable) (time.Time, error) {
+	d, err := lt.At(s.TransmitTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.TransmitTime.Add(d), nil
+}
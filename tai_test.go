@@ -0,0 +1,65 @@
+package ntp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+// leapTable holds the last three values of TAI-UTC.
+var leapTable = LeapTable{
+	{time.Date(2012, 7, 1, 0, 0, 0, 0, time.UTC), 35},
+	{time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC), 36},
+	{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), 37},
+}
+
+func TestLeapTable(t *testing.T) {
+	tests := []struct {
+		at   time.Time
+		want time.Duration
+		err  error
+	}{
+		{time.Date(2012, 6, 30, 23, 59, 59, 0, time.UTC), 0, ErrLeapTableRange},
+		{time.Date(2012, 7, 1, 0, 0, 0, 0, time.UTC), 35 * time.Second, nil},
+		{time.Date(2016, 12, 31, 23, 59, 59, 999999999, time.UTC), 36 * time.Second, nil},
+		{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), 37 * time.Second, nil},
+		{t0, 37 * time.Second, nil},
+	}
+	for _, tt := range tests {
+		got, err := leapTable.At(tt.at)
+		if got != tt.want || err != tt.err {
+			t.Errorf("At(%v) = %v, %v, want %v, %v", tt.at, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := LeapTable(nil).At(t0); err != ErrLeapTableRange {
+		t.Errorf("empty table: err = %v, want ErrLeapTableRange", err)
+	}
+
+	tai, err := NtpStats{TransmitTime: t0}.TAI(leapTable)
+	if err != nil || !tai.Equal(t0.Add(37*time.Second)) {
+		t.Errorf("TAI() = %v, %v, want 37s after %v", tai, err, t0)
+	}
+}
+
+func TestTAIOffset(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2, Offset: 20 * ms})
+	stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, LeapTable: leapTable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TAIOffset != stats.Offset+37*time.Second {
+		t.Errorf("TAIOffset = %v with offset %v, want 37s more", stats.TAIOffset, stats.Offset)
+	}
+
+	stats, err = QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+	if err != nil || stats.TAIOffset != 0 {
+		t.Errorf("without a table: TAIOffset %v, err %v", stats.TAIOffset, err)
+	}
+
+	// A table starting after the server's time does not cover it.
+	future := LeapTable{{time.Now().Add(time.Hour), 38}}
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, LeapTable: future}); err != ErrLeapTableRange {
+		t.Errorf("table from the future: err = %v, want ErrLeapTableRange", err)
+	}
+}
@@ -0,0 +1,235 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// A FilterMode selects how a Tracker combines successive offset samples.
+type FilterMode int
+
+const (
+	// Smoothing applies exponential smoothing to the offsets.
+	Smoothing FilterMode = iota
+	// Median reports the median of the most recent offsets, which is
+	// robust to single outliers such as a delayed packet.
+	Median
+)
+
+// A Tracker follows the offset of the local clock over a series of
+// queries.  A Tracker is not safe for concurrent use.
+type Tracker struct {
+	// StepThreshold, if non-zero, enables step detection: when two
+	// successive samples both differ from the estimate by more than
+	// StepThreshold in the same direction, the local clock is taken to
+	// have been stepped, and the Tracker discards its history and
+	// restarts from the latest sample.  ntpd steps the clock for offsets
+	// above 128ms, a reasonable threshold.
+	StepThreshold time.Duration
+
+	// OnStep, if set, is called with the old and new estimates when a
+	// step is detected.
+	OnStep func(from, to time.Duration)
+
+	mode    FilterMode
+	n       int
+	samples []time.Duration
+	recent  []NtpStats // the samples themselves, for Drift
+	offset  time.Duration
+	weight  float64       // decayed sum of sample weights, for Smoothing
+	spike   time.Duration // deviation of the last sample if beyond StepThreshold
+	stepped bool
+}
+
+// NewTracker returns a Tracker using the given filter mode.  For
+// Smoothing each new sample is weighted 1/n against the running estimate
+// when all samples are equally noisy, and more or less than that as its
+// Noise is below or above that of recent samples; for Median the estimate
+// is the median of the last n samples, regardless of noise.  n is raised
+// to 1 if smaller.
+func NewTracker(mode FilterMode, n int) *Tracker {
+	if n < 1 {
+		n = 1
+	}
+	return &Tracker{mode: mode, n: n}
+}
+
+// Update adds the offset of s to the tracker and returns the new
+// estimate.
+func (t *Tracker) Update(s NtpStats) time.Duration {
+	t.stepped = false
+	if t.StepThreshold > 0 && len(t.samples) > 0 {
+		dev := s.Offset - t.offset
+		switch {
+		case abs(dev) <= t.StepThreshold:
+			t.spike = 0
+		case t.spike != 0 && (t.spike < 0) == (dev < 0):
+			from := t.offset
+			t.samples, t.recent, t.weight, t.spike = nil, nil, 0, 0
+			t.stepped = true
+			defer func() {
+				if t.OnStep != nil {
+					t.OnStep(from, t.offset)
+				}
+			}()
+		default:
+			t.spike = dev
+		}
+	}
+
+	t.samples = append(t.samples, s.Offset)
+	t.recent = append(t.recent, s)
+	if len(t.samples) > t.n {
+		t.samples = t.samples[len(t.samples)-t.n:]
+		t.recent = t.recent[len(t.recent)-t.n:]
+	}
+
+	if t.mode == Median {
+		t.offset = median(t.samples)
+		return t.offset
+	}
+
+	// Weight samples by inverse variance.  The decay makes the steady
+	// state gain 1/n for samples of constant noise.
+	noise := s.Noise()
+	if noise < minNoise {
+		noise = minNoise
+	}
+	w := 1 / (noise.Seconds() * noise.Seconds())
+	t.weight = t.weight*(1-1/float64(t.n)) + w
+	t.offset += time.Duration(float64(s.Offset-t.offset) * w / t.weight)
+	return t.offset
+}
+
+// minNoise is the noise assumed for samples reporting less.
+const minNoise = time.Microsecond
+
+// Stepped reports whether the last Update detected a step of the local
+// clock.
+func (t *Tracker) Stepped() bool {
+	return t.stepped
+}
+
+// Offset returns the current offset estimate.
+func (t *Tracker) Offset() time.Duration {
+	return t.offset
+}
+
+// Drift returns the rate at which the offset changes, in seconds per
+// second, fitted by FitOffset over the last n samples: the frequency
+// error of the local clock, positive if it runs slow.  It is zero until
+// two samples have been taken.
+func (t *Tracker) Drift() float64 {
+	if len(t.recent) < 2 {
+		return 0
+	}
+	_, drift, _ := FitOffset(t.recent)
+	return drift
+}
+
+// Model returns a ClockModel of the local clock with the current offset
+// estimate, taken at the time of the latest sample, and drift.
+func (t *Tracker) Model() ClockModel {
+	m := ClockModel{Offset: t.offset, Drift: t.Drift()}
+	if len(t.recent) > 0 {
+		m.At = t.recent[len(t.recent)-1].midpoint()
+	}
+	return m
+}
+
+// A ClockModel describes the error of the local clock as an offset
+// measured at a local time and the rate at which it drifts, for
+// correcting the clock between queries.
+type ClockModel struct {
+	Offset time.Duration // offset at At
+	Drift  float64       // change of the offset in seconds per second
+	At     time.Time     // local time Offset was measured at
+}
+
+// Now returns the current time corrected by the model.
+func (m ClockModel) Now() time.Time {
+	return m.Correct(time.Now())
+}
+
+// Correct returns the local time t corrected by the offset projected to
+// t along the drift.
+func (m ClockModel) Correct(t time.Time) time.Time {
+	drift := time.Duration(m.Drift * float64(t.Sub(m.At)))
+	return t.Add(m.Offset + drift)
+}
+
+// ErrNotStabilized is returned by StabilizedOffset, along with the last
+// estimate, when the estimate has not settled within the allowed samples.
+var ErrNotStabilized = errors.New("offset did not stabilize")
+
+// StabilizedOffset queries host repeatedly through a Client, every 4
+// seconds whatever poll interval the server advertises, feeding a
+// smoothing Tracker, until two successive estimates differ by less than
+// tol, and returns the latest one.  After maxSamples queries it gives
+// up, returning the estimate so far and ErrNotStabilized, or the last
+// error if no query succeeded.
+func StabilizedOffset(host string, tol time.Duration, maxSamples int, opt QueryOptions) (time.Duration, error) {
+	return StabilizedOffsetContext(context.Background(), host, tol, maxSamples, opt)
+}
+
+// StabilizedOffsetContext is like StabilizedOffset but gives up,
+// returning ctx.Err(), when ctx is done.
+func StabilizedOffsetContext(ctx context.Context, host string, tol time.Duration, maxSamples int, opt QueryOptions) (time.Duration, error) {
+	c := &Client{Host: host, Options: opt, MinInterval: stabilizeInterval}
+	offset, err := stabilize(func() (NtpStats, error) {
+		if err := ctx.Err(); err != nil {
+			return NtpStats{}, err
+		}
+		return c.QueryContext(ctx)
+	}, tol, maxSamples)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return offset, err
+}
+
+// stabilizeInterval is the spacing of the queries of StabilizedOffset,
+// fixed so that the server's poll interval cannot stall it.  Tests
+// shorten it.
+var stabilizeInterval = defaultMinInterval
+
+// stabilize implements StabilizedOffset, taking samples from next.
+func stabilize(next func() (NtpStats, error), tol time.Duration, maxSamples int) (time.Duration, error) {
+	t := NewTracker(Smoothing, 4)
+	var est time.Duration
+	var err error
+	have := false
+	for i := 0; i < maxSamples; i++ {
+		var s NtpStats
+		s, err = next()
+		if err != nil {
+			continue
+		}
+		prev := est
+		est = t.Update(s)
+		if have && abs(est-prev) < tol {
+			return est, nil
+		}
+		have = true
+	}
+	if !have && err != nil {
+		return 0, err
+	}
+	return est, ErrNotStabilized
+}
+
+// median returns the median of d, or zero if d is empty.
+func median(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,293 @@
+package ntp
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestTrackerMedian(t *testing.T) {
+	// A burst around 2ms with one packet delayed by half a second.
+	offsets := []time.Duration{2 * ms, 3 * ms, 500 * ms, 1 * ms, 2 * ms}
+
+	m := NewTracker(Median, 5)
+	s := NewTracker(Smoothing, 5)
+	for _, o := range offsets {
+		m.Update(NtpStats{Offset: o})
+		s.Update(NtpStats{Offset: o})
+	}
+	if got := m.Offset(); got != 2*ms {
+		t.Errorf("median estimate = %v, want 2ms", got)
+	}
+	if got := s.Offset(); got < 50*ms {
+		t.Errorf("smoothed estimate = %v, expected the outlier to pull it up", got)
+	}
+}
+
+func TestTrackerMedianWindow(t *testing.T) {
+	m := NewTracker(Median, 3)
+	for _, o := range []time.Duration{100 * ms, 100 * ms, 100 * ms, 1 * ms, 2 * ms, 3 * ms} {
+		m.Update(NtpStats{Offset: o})
+	}
+	// Only the last three samples count.
+	if got := m.Offset(); got != 2*ms {
+		t.Errorf("estimate = %v, want 2ms", got)
+	}
+
+	even := NewTracker(Median, 4)
+	for _, o := range []time.Duration{1 * ms, 2 * ms, 4 * ms, 10 * ms} {
+		even.Update(NtpStats{Offset: o})
+	}
+	if got := even.Offset(); got != 3*ms {
+		t.Errorf("even window estimate = %v, want the mean of the middle two, 3ms", got)
+	}
+}
+
+func TestTrackerNoiseWeighting(t *testing.T) {
+	// Precise samples at 0 alternate with samples 100 times noisier at
+	// 100ms.
+	precise := NtpStats{Precision: ms}
+	noisy := NtpStats{Offset: 100 * ms, Precision: 100 * ms}
+
+	weighted := NewTracker(Smoothing, 8)
+	equal := NewTracker(Smoothing, 8)
+	for i := 0; i < 40; i++ {
+		s := precise
+		if i%2 == 1 {
+			s = noisy
+		}
+		weighted.Update(s)
+		s.Precision = ms
+		equal.Update(s)
+	}
+	if got := weighted.Offset(); got < 0 || got > ms {
+		t.Errorf("weighted estimate = %v, want within 1ms of the precise samples", got)
+	}
+	if got := equal.Offset(); got < 40*ms || got > 60*ms {
+		t.Errorf("estimate of equally noisy samples = %v, want about 50ms", got)
+	}
+}
+
+func TestNoise(t *testing.T) {
+	if n := (NtpStats{Precision: 3 * ms, RootDispersion: 4 * ms}).Noise(); n != 5*ms {
+		t.Errorf("Noise() = %v, want 5ms", n)
+	}
+
+	m := serverMsg(t0, t0.Add(10*ms), t0.Add(11*ms))
+	m.Precision = 0xf6 // -10
+	stats, err := StatsFromPacket(encodeMsg(m), t0.Add(21*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Second >> 10; stats.Precision != want {
+		t.Errorf("Precision = %v, want %v", stats.Precision, want)
+	}
+
+	if n := (NtpStats{Precision: log2ToDuration(127), RootDispersion: time.Second}).Noise(); n != math.MaxInt64 {
+		t.Errorf("Noise() with precision 2^127 = %v, want the longest Duration", n)
+	}
+}
+
+func TestTrackerStep(t *testing.T) {
+	var steps [][2]time.Duration
+	tr := NewTracker(Smoothing, 8)
+	tr.StepThreshold = 128 * ms
+	tr.OnStep = func(from, to time.Duration) { steps = append(steps, [2]time.Duration{from, to}) }
+
+	sample := func(offset time.Duration) NtpStats { return NtpStats{Offset: offset, Precision: ms} }
+	for i := 0; i < 10; i++ {
+		tr.Update(sample(2 * ms))
+	}
+
+	// A lone spike is smoothed over, not taken for a step.
+	tr.Update(sample(time.Second))
+	if tr.Stepped() || len(steps) != 0 {
+		t.Fatal("step detected after one deviating sample")
+	}
+	tr.Update(sample(2 * ms))
+
+	// The local clock is stepped back a second: two samples in a row
+	// deviate the same way.
+	tr.Update(sample(time.Second))
+	if tr.Stepped() {
+		t.Fatal("step detected after one deviating sample")
+	}
+	got := tr.Update(sample(time.Second))
+	if !tr.Stepped() || got != time.Second {
+		t.Fatalf("after the step: Stepped %v, estimate %v, want a step and 1s", tr.Stepped(), got)
+	}
+	if len(steps) != 1 || steps[0][1] != time.Second || steps[0][0] > 500*ms {
+		t.Errorf("OnStep calls %v, want one to 1s from the smoothed estimate below 500ms", steps)
+	}
+
+	tr.Update(sample(time.Second + ms))
+	if tr.Stepped() {
+		t.Error("Stepped still set after a normal sample")
+	}
+}
+
+func TestClockModel(t *testing.T) {
+	// A local clock 1ms slow at t0 and losing 10µs a second.
+	tr := NewTracker(Smoothing, 10)
+	for i := 0; i < 10; i++ {
+		tr.Update(driftSample(time.Duration(i)*time.Second, 10*ms))
+	}
+	m := tr.Model()
+	if m.Offset != tr.Offset() {
+		t.Errorf("Offset = %v, want the estimate %v", m.Offset, tr.Offset())
+	}
+	if !m.At.Equal(t0.Add(9 * time.Second)) {
+		t.Errorf("At = %v, want the time of the latest sample", m.At)
+	}
+	if m.Drift < 9.99e-6 || m.Drift > 10.01e-6 {
+		t.Errorf("Drift = %g, want 10 ppm", m.Drift)
+	}
+
+	// Over 100s the clock loses another 1ms.
+	later := m.At.Add(100 * time.Second)
+	if d := m.Correct(later).Sub(later) - (m.Offset + ms); abs(d) > time.Microsecond {
+		t.Errorf("correction 100s on is %v off the projected offset", d)
+	}
+
+	m = ClockModel{Offset: time.Hour, Drift: 1e-3, At: time.Now().Add(-time.Second)}
+	before := time.Now()
+	now := m.Now()
+	after := time.Now()
+	if now.Before(before.Add(time.Hour+ms)) || now.After(after.Add(time.Hour+ms+10*time.Microsecond)) {
+		t.Errorf("Now() = %v, want an hour and a millisecond ahead of the local clock", now)
+	}
+}
+
+func TestStabilize(t *testing.T) {
+	// Offsets converging on 10ms, halving their distance each sample,
+	// with a failed query thrown in.
+	failed := errors.New("query failed")
+	calls := 0
+	converging := func() (NtpStats, error) {
+		calls++
+		if calls == 3 {
+			return NtpStats{}, failed
+		}
+		return NtpStats{Offset: 10*ms + 80*ms>>uint(calls)}, nil
+	}
+	est, err := stabilize(converging, ms, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls >= 20 {
+		t.Errorf("took all %d samples to settle", calls)
+	}
+	if est < 10*ms || est > 15*ms {
+		t.Errorf("estimate %v, want close to 10ms", est)
+	}
+
+	// Offsets swinging by 200ms never settle.
+	calls = 0
+	swinging := func() (NtpStats, error) {
+		calls++
+		return NtpStats{Offset: time.Duration(1-2*(calls%2)) * 100 * ms}, nil
+	}
+	if _, err := stabilize(swinging, ms, 6); err != ErrNotStabilized || calls != 6 {
+		t.Errorf("swinging offsets: err = %v after %d samples, want ErrNotStabilized after 6", err, calls)
+	}
+
+	if _, err := stabilize(func() (NtpStats, error) { return NtpStats{}, failed }, ms, 3); err != failed {
+		t.Errorf("every query failing: err = %v, want the query error", err)
+	}
+}
+
+func TestStabilizedOffset(t *testing.T) {
+	defer func(d time.Duration) { stabilizeInterval = d }(stabilizeInterval)
+	stabilizeInterval = ms
+
+	// A poll of 2^33 seconds would hold a Client adopting it for
+	// centuries between samples.
+	s := newServer(t, ntptest.Reply{Stratum: 2, Poll: 33, Offset: 10 * ms})
+	start := time.Now()
+	est, err := StabilizedOffset(s.Host, 5*ms, 10, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v to settle", elapsed)
+	}
+	if est < 5*ms || est > 15*ms {
+		t.Errorf("estimate %v, want close to 10ms", est)
+	}
+}
+
+func TestTrackerState(t *testing.T) {
+	for _, mode := range []FilterMode{Smoothing, Median} {
+		orig := NewTracker(mode, 4)
+		for i := 0; i < 6; i++ {
+			s := driftSample(time.Duration(i)*time.Second, 10*ms)
+			s.Precision = time.Duration(i+1) * ms
+			orig.Update(s)
+		}
+		b, err := orig.MarshalState()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored := NewTracker(Smoothing, 1)
+		if err := restored.LoadState(b); err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		if restored.mode != mode || restored.n != 4 {
+			t.Errorf("mode %d: restored mode %d and length %d, want %d and 4", mode, restored.mode, restored.n, mode)
+		}
+		if restored.Offset() != orig.Offset() || restored.Drift() != orig.Drift() {
+			t.Errorf("mode %d: restored offset %v and drift %g, want %v and %g", mode, restored.Offset(), restored.Drift(), orig.Offset(), orig.Drift())
+		}
+		if m, o := restored.Model(), orig.Model(); m != o {
+			t.Errorf("mode %d: restored model %+v, want %+v", mode, m, o)
+		}
+
+		// Both carry on identically rather than the restored one starting
+		// over.
+		for i := 6; i < 9; i++ {
+			s := driftSample(time.Duration(i)*time.Second, 10*ms)
+			if got, want := restored.Update(s), orig.Update(s); got != want {
+				t.Errorf("mode %d, sample %d: restored estimate %v, want %v", mode, i, got, want)
+			}
+		}
+	}
+}
+
+func TestTrackerLoadStateInvalid(t *testing.T) {
+	orig := NewTracker(Smoothing, 4)
+	orig.Update(driftSample(0, 10*ms))
+	orig.Update(driftSample(time.Second, 10*ms))
+	b, err := orig.MarshalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badMode := append([]byte(nil), b...)
+	badMode[1] = 9
+	badN := append([]byte(nil), b...)
+	badN[4], badN[5], badN[6], badN[7] = 0, 0, 0, 0
+	badSample := append([]byte(nil), b...)
+	badSample[trackerStateLen+4] = 0 // version 0 of the first sample
+	for name, bad := range map[string][]byte{
+		"empty":          nil,
+		"header only":    b[:trackerStateLen-1],
+		"version 0":      append([]byte{0}, b[1:]...),
+		"mode":           badMode,
+		"length":         badN,
+		"truncated":      b[:len(b)-1],
+		"invalid sample": badSample,
+	} {
+		tr := NewTracker(Median, 3)
+		tr.Update(NtpStats{Offset: 7 * ms})
+		if err := tr.LoadState(bad); err != ErrTrackerState {
+			t.Errorf("%s: err = %v, want ErrTrackerState", name, err)
+		}
+		if tr.mode != Median || tr.n != 3 || tr.Offset() != 7*ms || len(tr.samples) != 1 {
+			t.Errorf("%s: tracker changed by a failed LoadState", name)
+		}
+	}
+}
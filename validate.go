@@ -0,0 +1,131 @@
+package ntp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Errors returned by strict validation.
+var (
+	ErrInvalidMode           = errors.New("reply is not in server mode")
+	ErrInvalidStratum        = errors.New("reply stratum out of range")
+	ErrServerNotSynchronized = errors.New("server leap indicator is alarm")
+	ErrRootDistance          = errors.New("root distance too large")
+	ErrTransmitBeforeReceive = errors.New("server transmit time before receive time")
+	ErrTransmitBeforeRef     = errors.New("server transmit time before reference time")
+	ErrVersionMismatch       = errors.New("reply version differs from request")
+)
+
+// ErrUnexpectedRefID is wrapped in the error returned when a stratum 1
+// reply does not carry QueryOptions.ExpectedRefID or one of
+// QueryOptions.AllowedRefIDs.
+var ErrUnexpectedRefID = errors.New("unexpected reference ID")
+
+// ErrSpoofedReply is returned, with QueryOptions.SpoofCheck, for replies
+// whose timestamps look forged.
+var ErrSpoofedReply = errors.New("reply timestamps implausible")
+
+// ErrPrecisionTooCoarse is returned when a reply advertises a precision
+// coarser than QueryOptions.MinPrecision.
+var ErrPrecisionTooCoarse = errors.New("server precision too coarse")
+
+// maxRootDistance is the largest root distance accepted in strict mode,
+// MAXDIST in RFC 5905.
+const maxRootDistance = 1500 * time.Millisecond
+
+// leapAlarm is the leap indicator of an unsynchronized server.
+const leapAlarm = 3
+
+// An AlarmCheck selects when replies whose leap indicator is alarm are
+// rejected with ErrServerNotSynchronized.
+type AlarmCheck int
+
+const (
+	AlarmCheckStrict AlarmCheck = iota // only in Strict mode
+	AlarmCheckOn                       // always
+	AlarmCheckOff                      // never
+)
+
+func (c AlarmCheck) enabled(strict bool) bool {
+	return c == AlarmCheckOn || c == AlarmCheckStrict && strict
+}
+
+// StrictOffset queries host with every check enabled and returns only
+// the offset.  Strict mode and the alarm check are forced on and
+// BestEffort off, so any failure, from a kiss-o'-death or unsynchronized
+// server to a root distance over 1.5 seconds, is returned as an error.
+func StrictOffset(host string, opt QueryOptions) (time.Duration, error) {
+	return StrictOffsetContext(context.Background(), host, opt)
+}
+
+// StrictOffsetContext is like StrictOffset but gives up, returning
+// ctx.Err(), when ctx is done.
+func StrictOffsetContext(ctx context.Context, host string, opt QueryOptions) (time.Duration, error) {
+	opt.Strict = true
+	opt.AlarmCheck = AlarmCheckOn
+	opt.BestEffort = false
+	stats, err := QueryContext(ctx, host, opt)
+	if err != nil {
+		return 0, err
+	}
+	return stats.Offset, nil
+}
+
+// validateStrict applies the RFC 5905 client-side sanity checks that
+// Request does not make by default to the reply m and the stats computed
+// from it, returning every violation found.  The origin and zero
+// timestamp checks are always made, and the leap indicator is checked
+// according to QueryOptions.AlarmCheck.
+func validateStrict(m *msg, stats NtpStats) []error {
+	var errs []error
+	if Mode(m.LiVnMode&0x07) != ModeServer {
+		errs = append(errs, ErrInvalidMode)
+	}
+	if m.Stratum < 1 || m.Stratum > 15 {
+		errs = append(errs, ErrInvalidStratum)
+	}
+	if stats.RootDistance() > maxRootDistance {
+		errs = append(errs, ErrRootDistance)
+	}
+	if stats.TransmitTime.Before(stats.ReceiveTime) {
+		errs = append(errs, ErrTransmitBeforeReceive)
+	}
+	if stats.TransmitTime.Before(stats.ReferenceTime) {
+		errs = append(errs, ErrTransmitBeforeRef)
+	}
+	return errs
+}
+
+// checkSpoof returns ErrSpoofedReply if the receive or transmit time of
+// the reply m merely echoes its origin time, if they are not distinct,
+// unless single is set, and in order, or if the transmit time is further
+// than window from the destination time.
+func checkSpoof(m *msg, stats NtpStats, window time.Duration, single bool) error {
+	if m.ReceiveTime == m.OriginTime || m.TransmitTime == m.OriginTime {
+		return ErrSpoofedReply
+	}
+	if stats.TransmitTime.Before(stats.ReceiveTime) || !single && stats.TransmitTime.Equal(stats.ReceiveTime) {
+		return ErrSpoofedReply
+	}
+	if abs(stats.TransmitTime.Sub(stats.DestinationTime)) > window {
+		return ErrSpoofedReply
+	}
+	return nil
+}
+
+// warnings are the validation failures that BestEffort queries report in
+// NtpStats.Warnings instead of failing.
+var warnings = []error{
+	ErrRootDistance, ErrTransmitBeforeReceive, ErrTransmitBeforeRef,
+	ErrVersionMismatch, ErrUnexpectedRefID, ErrPrecisionTooCoarse,
+}
+
+func isWarning(err error) bool {
+	for _, w := range warnings {
+		if errors.Is(err, w) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,418 @@
+package ntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/NuVivo314/ntp/ntptest"
+)
+
+func TestExpectedRefID(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	tests := []struct {
+		stratum  byte
+		refID    string
+		expected string
+		ok       bool
+	}{
+		{1, "GPS", "GPS", true},
+		{1, "GPS", "", true},
+		{1, "PPS", "GPS", false},
+		{1, "", "GPS", false},
+		// Only stratum 1 reference IDs name a clock source.
+		{2, "PPS", "GPS", true},
+	}
+	for _, tt := range tests {
+		s.SetReply(ntptest.Reply{Stratum: tt.stratum, ReferenceID: tt.refID})
+		_, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, ExpectedRefID: tt.expected})
+		if tt.ok && err != nil {
+			t.Errorf("stratum %d %q, expecting %q: %v", tt.stratum, tt.refID, tt.expected, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnexpectedRefID) {
+			t.Errorf("stratum %d %q, expecting %q: err = %v, want ErrUnexpectedRefID", tt.stratum, tt.refID, tt.expected, err)
+		}
+	}
+}
+
+func TestAllowedRefIDs(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	allowed := []string{"GPS", "PPS", "DCF"}
+	tests := []struct {
+		stratum byte
+		refID   string
+		allowed []string
+		ok      bool
+	}{
+		{1, "GPS", allowed, true},
+		{1, "DCF", allowed, true},
+		{1, "GOES", allowed, false},
+		{1, "gps", allowed, false},
+		{1, "", allowed, false},
+		{1, "GOES", nil, true},
+		// Only stratum 1 reference IDs name a clock source.
+		{2, "GOES", allowed, true},
+	}
+	for _, tt := range tests {
+		s.SetReply(ntptest.Reply{Stratum: tt.stratum, ReferenceID: tt.refID})
+		_, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, AllowedRefIDs: tt.allowed})
+		if tt.ok && err != nil {
+			t.Errorf("stratum %d %q, allowing %q: %v", tt.stratum, tt.refID, tt.allowed, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnexpectedRefID) {
+			t.Errorf("stratum %d %q, allowing %q: err = %v, want ErrUnexpectedRefID", tt.stratum, tt.refID, tt.allowed, err)
+		}
+	}
+}
+
+func TestMinPrecision(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	exact := log2ToDuration(-10) // 976.5625µs
+	tests := []struct {
+		precision int8
+		min       time.Duration
+		ok        bool
+	}{
+		{-10, ms, true},
+		{-9, ms, false},
+		{-10, exact, true},
+		{-10, exact - 1, false},
+		{-20, ms, true},
+		{0, 0, true},
+		{33, ms, false},
+		{34, ms, false},
+		{40, ms, false},
+		{127, ms, false},
+		{127, 0, true},
+	}
+	for _, tt := range tests {
+		s.SetReply(ntptest.Reply{Stratum: 2, Precision: tt.precision})
+		_, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, MinPrecision: tt.min})
+		if tt.ok && err != nil {
+			t.Errorf("precision 2^%d with MinPrecision %v: %v", tt.precision, tt.min, err)
+		}
+		if !tt.ok && err != ErrPrecisionTooCoarse {
+			t.Errorf("precision 2^%d with MinPrecision %v: err = %v, want ErrPrecisionTooCoarse", tt.precision, tt.min, err)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	now := time.Now()
+	tests := []struct {
+		name  string
+		reply ntptest.Reply
+		err   error
+	}{
+		{"alarm", ntptest.Reply{Stratum: 2, Leap: leapAlarm}, ErrServerNotSynchronized},
+		{"stratum", ntptest.Reply{Stratum: 17}, ErrInvalidStratum},
+		{"root distance", ntptest.Reply{Stratum: 2, RootDispersion: 2 * time.Second}, ErrRootDistance},
+		{"transmit before receive", ntptest.Reply{Stratum: 2, ReceiveTime: now.Add(time.Second), TransmitTime: now}, ErrTransmitBeforeReceive},
+		{"transmit before reference", ntptest.Reply{Stratum: 2, ReferenceTime: now.Add(time.Hour)}, ErrTransmitBeforeRef},
+		{"version", ntptest.Reply{Stratum: 2, Version: 3}, ErrVersionMismatch},
+	}
+	for _, tt := range tests {
+		s.SetReply(tt.reply)
+		if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port}); err != nil {
+			t.Errorf("%s: lenient query failed: %v", tt.name, err)
+		}
+		if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, Strict: true}); !errors.Is(err, tt.err) {
+			t.Errorf("%s: strict query: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	s.SetReply(ntptest.Reply{Stratum: 2})
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, Strict: true}); err != nil {
+		t.Errorf("strict query of a sound server: %v", err)
+	}
+}
+
+func TestValidateStrictMode(t *testing.T) {
+	m := serverMsg(t0, t0.Add(10*ms), t0.Add(11*ms))
+	m.SetMode(ModeSymmetricPassive)
+	stats, err := computeStats(m, t0, t0.Add(21*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := validateStrict(m, stats); len(errs) != 1 || errs[0] != ErrInvalidMode {
+		t.Errorf("validateStrict() = %v, want [ErrInvalidMode]", errs)
+	}
+}
+
+func TestMaxTime(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	absurd := time.Date(2103, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		reply   ntptest.Reply
+		maxTime time.Time
+		err     error
+	}{
+		{"current", ntptest.Reply{Stratum: 2}, time.Time{}, nil},
+		{"absurd transmit", ntptest.Reply{Stratum: 2, TransmitTime: absurd}, time.Time{}, ErrFutureTimestamp},
+		{"absurd receive", ntptest.Reply{Stratum: 2, ReceiveTime: absurd}, time.Time{}, ErrFutureTimestamp},
+		{"raised limit", ntptest.Reply{Stratum: 2, ReceiveTime: absurd, TransmitTime: absurd}, absurd.Add(time.Second), nil},
+		{"lowered limit", ntptest.Reply{Stratum: 2, Offset: time.Hour}, time.Now().Add(time.Minute), ErrFutureTimestamp},
+	}
+	for _, tt := range tests {
+		s.SetReply(tt.reply)
+		_, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, MaxTime: tt.maxTime})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	now := time.Now()
+	tests := []struct {
+		name    string
+		reply   ntptest.Reply
+		opt     QueryOptions
+		err     error
+		warning bool
+	}{
+		{"root distance", ntptest.Reply{Stratum: 2, RootDispersion: 2 * time.Second}, QueryOptions{}, ErrRootDistance, true},
+		{"transmit before receive", ntptest.Reply{Stratum: 2, ReceiveTime: now.Add(time.Second), TransmitTime: now}, QueryOptions{}, ErrTransmitBeforeReceive, true},
+		{"transmit before reference", ntptest.Reply{Stratum: 2, ReferenceTime: now.Add(time.Hour)}, QueryOptions{}, ErrTransmitBeforeRef, true},
+		{"version", ntptest.Reply{Stratum: 2, Version: 3}, QueryOptions{}, ErrVersionMismatch, true},
+		{"reference ID", ntptest.Reply{Stratum: 1, ReferenceID: "PPS"}, QueryOptions{ExpectedRefID: "GPS"}, ErrUnexpectedRefID, true},
+		{"precision", ntptest.Reply{Stratum: 2, Precision: -6}, QueryOptions{MinPrecision: ms}, ErrPrecisionTooCoarse, true},
+		{"stratum", ntptest.Reply{Stratum: 17}, QueryOptions{}, ErrInvalidStratum, false},
+		{"alarm", ntptest.Reply{Stratum: 2, Leap: leapAlarm}, QueryOptions{}, ErrServerNotSynchronized, false},
+		{"unsynchronized", ntptest.Reply{Stratum: 16}, QueryOptions{}, ErrUnsynchronizedServer, false},
+	}
+	for _, tt := range tests {
+		s.SetReply(tt.reply)
+		opt := tt.opt
+		opt.Port, opt.Strict, opt.BestEffort = s.Port, true, true
+		stats, err := QueryWithOptions(s.Host, opt)
+		if !tt.warning {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: err = %v, want a warning", tt.name, err)
+			continue
+		}
+		if len(stats.Warnings) != 1 || !errors.Is(stats.Warnings[0], tt.err) {
+			t.Errorf("%s: Warnings = %v, want %v", tt.name, stats.Warnings, tt.err)
+		}
+	}
+}
+
+func TestAlarmCheck(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2, Leap: leapAlarm})
+	tests := []struct {
+		check  AlarmCheck
+		strict bool
+		reject bool
+	}{
+		{AlarmCheckStrict, false, false},
+		{AlarmCheckStrict, true, true},
+		{AlarmCheckOn, false, true},
+		{AlarmCheckOn, true, true},
+		{AlarmCheckOff, false, false},
+		{AlarmCheckOff, true, false},
+	}
+	for _, tt := range tests {
+		stats, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, AlarmCheck: tt.check, Strict: tt.strict})
+		if tt.reject && !errors.Is(err, ErrServerNotSynchronized) {
+			t.Errorf("AlarmCheck %d, Strict %v: err = %v, want ErrServerNotSynchronized", tt.check, tt.strict, err)
+		}
+		if !tt.reject && (err != nil || stats.Leap != leapAlarm) {
+			t.Errorf("AlarmCheck %d, Strict %v: err = %v, leap %d, want the alarm reply accepted", tt.check, tt.strict, err, stats.Leap)
+		}
+	}
+
+	// Other leap indicators pass the check.
+	s.SetReply(ntptest.Reply{Stratum: 2, Leap: 1})
+	if _, err := QueryWithOptions(s.Host, QueryOptions{Port: s.Port, AlarmCheck: AlarmCheckOn}); err != nil {
+		t.Errorf("leap indicator 1: %v", err)
+	}
+}
+
+func TestStrictOffset(t *testing.T) {
+	s := newServer(t, ntptest.Reply{Stratum: 2, Offset: 40 * ms})
+	// Options that would let a lenient query succeed are overridden.
+	opt := QueryOptions{Port: s.Port, BestEffort: true, AlarmCheck: AlarmCheckOff}
+
+	offset, err := StrictOffset(s.Host, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 35*ms || offset > 45*ms {
+		t.Errorf("offset %v, want about 40ms", offset)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name  string
+		reply ntptest.Reply
+		err   error
+	}{
+		{"alarm", ntptest.Reply{Stratum: 2, Leap: leapAlarm}, ErrServerNotSynchronized},
+		{"unsynchronized", ntptest.Reply{Stratum: 16}, ErrUnsynchronizedServer},
+		{"stratum", ntptest.Reply{Stratum: 17}, ErrInvalidStratum},
+		{"root distance", ntptest.Reply{Stratum: 2, RootDispersion: 2 * time.Second}, ErrRootDistance},
+		{"transmit before receive", ntptest.Reply{Stratum: 2, ReceiveTime: now.Add(time.Second), TransmitTime: now}, ErrTransmitBeforeReceive},
+		{"transmit before reference", ntptest.Reply{Stratum: 2, ReferenceTime: now.Add(time.Hour)}, ErrTransmitBeforeRef},
+		{"version", ntptest.Reply{Stratum: 2, Version: 3}, ErrVersionMismatch},
+	}
+	for _, tt := range tests {
+		s.SetReply(tt.reply)
+		if offset, err := StrictOffset(s.Host, opt); !errors.Is(err, tt.err) || offset != 0 {
+			t.Errorf("%s: StrictOffset() = %v, %v, want 0, %v", tt.name, offset, err, tt.err)
+		}
+	}
+
+	s.SetReply(ntptest.Reply{Stratum: 0, ReferenceID: "RATE"})
+	var kod *KissOfDeathError
+	if _, err := StrictOffset(s.Host, opt); !errors.As(err, &kod) || kod.Code != "RATE" {
+		t.Errorf("kiss-o'-death: err = %v, want a RATE KissOfDeathError", err)
+	}
+
+	port := rawServer(t, func(req []byte) [][]byte {
+		now := time.Now()
+		return [][]byte{encodeMsg(serverMsg(now.Add(-time.Hour), now, now))}
+	})
+	if _, err := StrictOffset("127.0.0.1", QueryOptions{Port: port}); !errors.Is(err, ErrBogusPacket) {
+		t.Errorf("bogus reply: err = %v, want ErrBogusPacket", err)
+	}
+}
+
+func TestTransmitBeforeRef(t *testing.T) {
+	// A packet claiming the server last synchronized after it sent it.
+	m := serverMsg(t0, t0.Add(10*ms), t0.Add(11*ms))
+	m.ReferenceTime = toNtpTime(t0.Add(time.Second))
+	stats, err := computeStats(m, t0, t0.Add(21*ms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.TransmitBeforeRef {
+		t.Error("TransmitBeforeRef not set")
+	}
+	if errs := validateStrict(m, stats); len(errs) != 1 || errs[0] != ErrTransmitBeforeRef {
+		t.Errorf("validateStrict() = %v, want [ErrTransmitBeforeRef]", errs)
+	}
+
+	// Outside strict mode the query succeeds with the flag set.
+	s := newServer(t, ntptest.Reply{Stratum: 2, ReferenceTime: time.Now().Add(time.Hour)})
+	stats, err = QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.TransmitBeforeRef || len(stats.Warnings) != 0 {
+		t.Errorf("lenient query: TransmitBeforeRef %v, warnings %v, want the flag alone", stats.TransmitBeforeRef, stats.Warnings)
+	}
+
+	s.SetReply(ntptest.Reply{Stratum: 2, ReferenceTime: time.Now().Add(-time.Minute)})
+	stats, err = QueryWithOptions(s.Host, QueryOptions{Port: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TransmitBeforeRef {
+		t.Error("TransmitBeforeRef set for a reference time in the past")
+	}
+}
+
+func TestSpoofCheck(t *testing.T) {
+	// Each case answers with the request's transmit time as origin, and
+	// receive and transmit times derived from it and the current time.
+	tests := []struct {
+		name  string
+		times func(origin, now ntpTime) (recv, xmit ntpTime)
+		opt   QueryOptions
+		ok    bool
+	}{
+		{"honest", func(o, now ntpTime) (ntpTime, ntpTime) {
+			return now, toNtpTime(now.UTC().Add(ms))
+		}, QueryOptions{}, true},
+		{"echo", func(o, now ntpTime) (ntpTime, ntpTime) {
+			return o, o
+		}, QueryOptions{}, false},
+		{"receive echoes origin", func(o, now ntpTime) (ntpTime, ntpTime) {
+			return o, now
+		}, QueryOptions{}, false},
+		{"transmit echoes origin", func(o, now ntpTime) (ntpTime, ntpTime) {
+			return now, o
+		}, QueryOptions{}, false},
+		{"single stamp", func(o, now ntpTime) (ntpTime, ntpTime) {
+			return now, now
+		}, QueryOptions{}, false},
+		{"single stamp allowed", func(o, now ntpTime) (ntpTime, ntpTime) {
+			return now, now
+		}, QueryOptions{SingleStamp: true}, true},
+		{"out of order", func(o, now ntpTime) (ntpTime, ntpTime) {
+			return toNtpTime(now.UTC().Add(ms)), now
+		}, QueryOptions{}, false},
+		{"two days off", func(o, now ntpTime) (ntpTime, ntpTime) {
+			t := now.UTC().Add(48 * time.Hour)
+			return toNtpTime(t), toNtpTime(t.Add(ms))
+		}, QueryOptions{}, false},
+		{"two days off in a wider window", func(o, now ntpTime) (ntpTime, ntpTime) {
+			t := now.UTC().Add(48 * time.Hour)
+			return toNtpTime(t), toNtpTime(t.Add(ms))
+		}, QueryOptions{SpoofWindow: 72 * time.Hour}, true},
+	}
+	for _, tt := range tests {
+		times := tt.times
+		port := rawServer(t, func(req []byte) [][]byte {
+			origin := ntpTime{binary.BigEndian.Uint32(req[40:]), binary.BigEndian.Uint32(req[44:])}
+			m := serverMsg(time.Now(), time.Now(), time.Now())
+			m.OriginTime = origin
+			m.ReceiveTime, m.TransmitTime = times(origin, toNtpTime(time.Now()))
+			return [][]byte{encodeMsg(m)}
+		})
+
+		// Without the check even the forgeries pass.
+		opt := tt.opt
+		opt.Port = port
+		if _, err := QueryWithOptions("127.0.0.1", opt); err != nil {
+			t.Errorf("%s: query without SpoofCheck: %v", tt.name, err)
+		}
+		opt.SpoofCheck = true
+		_, err := QueryWithOptions("127.0.0.1", opt)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err != ErrSpoofedReply {
+			t.Errorf("%s: err = %v, want ErrSpoofedReply", tt.name, err)
+		}
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	s := newServer(t, ntptest.Reply{})
+	tests := []struct {
+		requested, replied byte
+		mismatch           bool
+	}{
+		{4, 3, true},
+		{3, 4, true},
+		{4, 4, false},
+		{3, 3, false},
+	}
+	for _, tt := range tests {
+		s.SetReply(ntptest.Reply{Stratum: 2, Version: tt.replied})
+		opt := QueryOptions{Port: s.Port, Version: tt.requested}
+		stats, err := QueryWithOptions(s.Host, opt)
+		if err != nil {
+			t.Fatalf("version %d answered with %d: %v", tt.requested, tt.replied, err)
+		}
+		if stats.Version != tt.replied || stats.VersionMismatch != tt.mismatch {
+			t.Errorf("version %d answered with %d: Version %d, VersionMismatch %v", tt.requested, tt.replied, stats.Version, stats.VersionMismatch)
+		}
+
+		opt.Strict = true
+		_, err = QueryWithOptions(s.Host, opt)
+		if tt.mismatch && err != ErrVersionMismatch || !tt.mismatch && err != nil {
+			t.Errorf("strict version %d answered with %d: err = %v", tt.requested, tt.replied, err)
+		}
+	}
+}